@@ -0,0 +1,311 @@
+package bencode
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minPieceLength     = 16 * 1024        // 16KB
+	maxPieceLength     = 16 * 1024 * 1024 // 16MB
+	targetPieceCount   = 1500
+	defaultCreatedByID = "mybittorrent"
+)
+
+// CreateOptions describes the torrent built by CreateTorrent.
+type CreateOptions struct {
+	Path        string     // file or directory to share
+	PieceLength int64      // piece length in bytes; zero picks one from the total size
+	Trackers    [][]string // tracker tiers; the first URL becomes "announce"
+	Comment     string
+	CreatedBy   string // defaults to the name of this client
+	Private     bool
+	WebSeeds    []string // "url-list" web seeds (BEP 19)
+	Workers     int      // number of hashing goroutines; zero uses every CPU
+}
+
+// metainfoFile is the top-level dictionary of a .torrent file.
+type metainfoFile struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Info         RawMessage `bencode:"info"`
+	URLList      []string   `bencode:"url-list,omitempty"`
+}
+
+// infoDict is the info dictionary of a v1 torrent.
+type infoDict struct {
+	Files       []fileDict `bencode:"files,omitempty"`
+	Length      *int64     `bencode:"length"`
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+}
+
+// fileDict is an entry of the files list of a multi-file info dictionary.
+type fileDict struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// sourceFile is a file on disk that becomes part of a torrent.
+type sourceFile struct {
+	path       string   // location on disk
+	components []string // path relative to the torrent's root
+	length     int64
+}
+
+// CreateTorrent builds a .torrent file for the file or directory at opts.Path
+// and writes it to w. Directories are walked in lexical order and become
+// multi-file torrents; only regular files are included.
+//
+// Parameters:
+// - opts: A CreateOptions struct describing the content and metadata of the torrent.
+// - w: The writer the bencoded metainfo is written to.
+//
+// Returns:
+// - A string containing the hexadecimal info hash of the new torrent.
+// - An error if the content cannot be read or the metainfo cannot be written.
+func CreateTorrent(opts CreateOptions, w io.Writer) (string, error) {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return "", err
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+
+	files, err := collectFiles(root, stat)
+	if err != nil {
+		return "", err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.length
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	}
+	if pieceLength <= 0 {
+		return "", fmt.Errorf("invalid piece length %d", pieceLength)
+	}
+
+	pieces, err := hashPieces(files, pieceLength, opts.Workers)
+	if err != nil {
+		return "", err
+	}
+
+	info := infoDict{
+		Name:        stat.Name(),
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+		Private:     opts.Private,
+	}
+
+	if stat.IsDir() {
+		for _, file := range files {
+			info.Files = append(info.Files, fileDict{Length: file.length, Path: file.components})
+		}
+	} else {
+		info.Length = &files[0].length
+	}
+
+	rawInfo, err := Marshal(info)
+	if err != nil {
+		return "", err
+	}
+
+	meta := metainfoFile{
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		Info:         rawInfo,
+		URLList:      opts.WebSeeds,
+	}
+
+	if meta.CreatedBy == "" {
+		meta.CreatedBy = defaultCreatedByID
+	}
+
+	var trackerCnt int
+	for _, tier := range opts.Trackers {
+		if len(tier) == 0 {
+			continue
+		}
+
+		if meta.Announce == "" {
+			meta.Announce = tier[0]
+		}
+		meta.AnnounceList = append(meta.AnnounceList, tier)
+		trackerCnt += len(tier)
+	}
+
+	if trackerCnt <= 1 {
+		meta.AnnounceList = nil
+	}
+
+	if err := NewEncoder(w).Encode(meta); err != nil {
+		return "", err
+	}
+
+	return calculateInfoHash(rawInfo), nil
+}
+
+// collectFiles lists the regular files making up the torrent rooted at root.
+func collectFiles(root string, stat fs.FileInfo) ([]sourceFile, error) {
+	if !stat.IsDir() {
+		if !stat.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", root)
+		}
+		return []sourceFile{{path: root, components: []string{stat.Name()}, length: stat.Size()}}, nil
+	}
+
+	var files []sourceFile
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, sourceFile{
+			path:       path,
+			components: strings.Split(filepath.ToSlash(rel), "/"),
+			length:     fileInfo.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s contains no files", root)
+	}
+	return files, nil
+}
+
+// choosePieceLength picks the smallest power of two between 16KB and 16MB
+// that splits total bytes into no more than about 1500 pieces.
+func choosePieceLength(total int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && total/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// pieceJob is a piece read from disk waiting to be hashed.
+type pieceJob struct {
+	index int
+	data  []byte
+}
+
+// hashPieces reads the concatenated content of files and returns the SHA-1
+// hashes of its pieces, concatenated. Pieces are read sequentially and hashed
+// by a pool of worker goroutines.
+func hashPieces(files []sourceFile, pieceLength int64, workers int) ([]byte, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.length
+	}
+
+	pieceCnt := int((total + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, pieceCnt*sha1.Size)
+
+	jobs := make(chan pieceJob, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				hash := sha1.Sum(job.data)
+				copy(pieces[job.index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	err := readPieces(files, pieceLength, func(index int, data []byte) {
+		jobs <- pieceJob{index: index, data: data}
+	})
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	return pieces, nil
+}
+
+// readPieces reads the concatenated content of files and calls handle with
+// each piece in order. Files are opened one at a time, and every piece is a
+// freshly allocated slice.
+func readPieces(files []sourceFile, pieceLength int64, handle func(index int, data []byte)) error {
+	piece := make([]byte, 0, pieceLength)
+	index := 0
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+
+		for remaining := file.length; remaining > 0; {
+			start := int64(len(piece))
+			n := min(pieceLength-start, remaining)
+			piece = piece[:start+n]
+			if _, err := io.ReadFull(f, piece[start:]); err != nil {
+				f.Close()
+				return fmt.Errorf("error reading %s: %w", file.path, err)
+			}
+			remaining -= n
+
+			if int64(len(piece)) == pieceLength {
+				handle(index, piece)
+				index++
+				piece = make([]byte, 0, pieceLength)
+			}
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	if len(piece) > 0 {
+		handle(index, piece)
+	}
+	return nil
+}
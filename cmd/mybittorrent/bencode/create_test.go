@@ -0,0 +1,96 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateTorrentRoundTrip(t *testing.T) {
+	const pieceLength = BlockSize
+
+	tests := []struct {
+		name string
+		dir  bool   // whether a directory is shared rather than a single file
+		want []File // in the order CreateTorrent lists them
+	}{
+		{
+			"single file",
+			false,
+			[]File{{Path: []string{"shared"}, Length: 3*pieceLength + 100}},
+		},
+		{
+			"multiple files",
+			true,
+			[]File{
+				{Path: []string{"a", "x.bin"}, Length: pieceLength + 10},
+				{Path: []string{"a", "y.bin"}, Length: 0, Offset: pieceLength + 10},
+				{Path: []string{"b.txt"}, Length: pieceLength / 2, Offset: pieceLength + 10},
+				{Path: []string{"c", "d", "e.bin"}, Length: 2 * pieceLength, Offset: pieceLength + 10 + pieceLength/2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		root := filepath.Join(t.TempDir(), "shared")
+		var data []byte
+		for i, file := range tt.want {
+			content := bytes.Repeat([]byte{byte(i + 1)}, int(file.Length))
+			data = append(data, content...)
+
+			path := root
+			if tt.dir {
+				path = filepath.Join(append([]string{root}, file.Path...)...)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, content, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var buf bytes.Buffer
+		opts := CreateOptions{
+			Path:        root,
+			PieceLength: pieceLength,
+			Trackers:    [][]string{{"http://a.example/announce"}, {"udp://b.example:80"}},
+			Workers:     3,
+		}
+		infoHash, err := CreateTorrent(opts, &buf)
+		if err != nil {
+			t.Fatalf("%s: CreateTorrent: %v", tt.name, err)
+		}
+
+		torrent, err := CreateParser(&buf).ParseTorrent()
+		if err != nil {
+			t.Fatalf("%s: ParseTorrent: %v", tt.name, err)
+		}
+
+		var pieceHashes []string
+		for start := 0; start < len(data); start += pieceLength {
+			hash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+			pieceHashes = append(pieceHashes, hex.EncodeToString(hash[:]))
+		}
+
+		if torrent.Name != "shared" || torrent.Length != int64(len(data)) || torrent.PieceLength != pieceLength {
+			t.Errorf("%s: name %q, length %d, piece length %d; want %q, %d, %d", tt.name, torrent.Name, torrent.Length, torrent.PieceLength, "shared", len(data), pieceLength)
+		}
+		if !reflect.DeepEqual(torrent.Files, tt.want) {
+			t.Errorf("%s: files = %+v, want %+v", tt.name, torrent.Files, tt.want)
+		}
+		if torrent.PieceCount() != len(pieceHashes) || !reflect.DeepEqual(torrent.PieceHashes, pieceHashes) {
+			t.Errorf("%s: %d piece hashes %v, want %d %v", tt.name, torrent.PieceCount(), torrent.PieceHashes, len(pieceHashes), pieceHashes)
+		}
+		if torrent.InfoHash != infoHash || calculateInfoHash(torrent.RawInfo) != infoHash {
+			t.Errorf("%s: info hash %s, want %s", tt.name, torrent.InfoHash, infoHash)
+		}
+		if torrent.Announce != "http://a.example/announce" || len(torrent.AnnounceList) != 2 {
+			t.Errorf("%s: announce %q, announce list %v", tt.name, torrent.Announce, torrent.AnnounceList)
+		}
+	}
+}
@@ -1,54 +1,285 @@
 package bencode
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"strconv"
 )
 
 type Decoder struct {
-	input string // bencoded input
-	index int    // current index in the input
+	reader    *bufio.Reader // buffered bencoded input
+	offset    int64         // number of bytes consumed from the input
+	strict    bool          // reject input that is not in canonical form
+	useBigInt bool          // decode integers beyond int64 into *big.Int
+	depth     int           // current nesting depth of lists and dictionaries
+	limits    Limits        // resource limits on the input
+
+	raw      bytes.Buffer       // bytes consumed while at least one capture is active
+	rawDepth int                // number of active captures
+	rawKeys  map[string]bool    // top-level dictionary keys whose values are recorded
+	rawSpans map[string]RawSpan // recorded values, by key
+}
+
+// RawSpan is the exact encoded form of a value as it appeared in the input.
+type RawSpan struct {
+	Offset int64  // offset of the first byte of the value in the input
+	Bytes  []byte // the encoded value
 }
 
-// NewDecoder creates a new Decoder with the specified input.
-func NewDecoder(input string) *Decoder {
-	return &Decoder{input: input}
+// NewDecoder creates a new Decoder that reads bencoded values from r.
+// The decoder buffers its input, so it may read more data from r than the
+// values it returns; use Buffered to get hold of the bytes read ahead.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r), limits: DefaultLimits}
 }
 
-// move moves the index by the specified number of steps.
-func (d *Decoder) move(steps int) {
-	d.index += steps
+// SetStrict enables or disables strict mode. In strict mode the decoder rejects
+// every non-canonical encoding with a *NonCanonicalError: integers with leading
+// zeros, a plus sign or "-0", string lengths with leading zeros, and dictionaries
+// whose keys are unsorted or duplicated. Only canonical input re-encodes to the
+// exact original bytes.
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
 }
 
-// moveNext moves the index to the next character in the input.
-func (d *Decoder) moveNext() {
-	d.move(1)
+// SetBigInt controls how integers that do not fit in an int64 are decoded.
+// When enabled they are returned as a *big.Int; otherwise decoding them fails
+// with an *OverflowError.
+func (d *Decoder) SetBigInt(enabled bool) {
+	d.useBigInt = enabled
 }
 
-// peek returns the next character in the input without consuming it.
-func (d *Decoder) peek() byte {
-	if d.index < len(d.input) {
-		return d.input[d.index]
+// RecordRaw asks the decoder to keep the raw encoded bytes of the values stored
+// under the given keys of the top-level dictionary. The recorded spans are
+// available through RawSpan once the dictionary has been decoded.
+func (d *Decoder) RecordRaw(keys ...string) {
+	if d.rawKeys == nil {
+		d.rawKeys = make(map[string]bool)
+	}
+	for _, key := range keys {
+		d.rawKeys[key] = true
 	}
-	return 0
 }
 
-// hasMore checks if there are more characters to read in the input.
-func (d *Decoder) hasMore() bool {
-	return d.index < len(d.input)
+// RawSpan returns the raw span recorded for the top-level dictionary key.
+func (d *Decoder) RawSpan(key string) (RawSpan, bool) {
+	span, ok := d.rawSpans[key]
+	return span, ok
+}
+
+// InputOffset returns the number of bytes of input consumed so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Buffered returns a reader of the data remaining in the decoder's buffer.
+// The reader is valid until the next call to Decode.
+func (d *Decoder) Buffered() io.Reader {
+	buffered, _ := d.reader.Peek(d.reader.Buffered())
+	return bytes.NewReader(buffered)
+}
+
+// peek returns the next byte in the input without consuming it.
+// If the input ends, the error reports that expected was missing from a value of type t.
+func (d *Decoder) peek(t Type, expected string) (byte, error) {
+	b, err := d.reader.Peek(1)
+	if err != nil {
+		return 0, d.unexpected(err, t, expected)
+	}
+	return b[0], nil
+}
+
+// next consumes and returns the next byte in the input.
+// If the input ends, the error reports that expected was missing from a value of type t.
+func (d *Decoder) next(t Type, expected string) (byte, error) {
+	if err := d.checkBytes(1); err != nil {
+		return 0, err
+	}
+
+	b, err := d.reader.ReadByte()
+	if err != nil {
+		return 0, d.unexpected(err, t, expected)
+	}
+	d.offset++
+	if d.rawDepth > 0 {
+		d.raw.WriteByte(b)
+	}
+	return b, nil
+}
+
+// expect consumes the next byte in the input, which must be want.
+func (d *Decoder) expect(t Type, want byte) error {
+	expected := fmt.Sprintf("%q", want)
+	b, err := d.next(t, expected)
+	if err != nil {
+		return err
+	}
+
+	if b != want {
+		return &SyntaxError{Offset: d.offset - 1, Type: t, Expected: expected, Found: b}
+	}
+	return nil
+}
+
+// readNumber consumes the decimal number of a value of type t up to and
+// including delim, and returns it without delim. The number may start with a
+// sign only if signed is set; whether a '+' sign is canonical is up to the
+// caller.
+func (d *Decoder) readNumber(t Type, delim byte, signed bool) ([]byte, error) {
+	expected := fmt.Sprintf("digit or %q", delim)
+	var token []byte
+	for {
+		b, err := d.next(t, expected)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case b == delim && isDecimal(token):
+			return token, nil
+		case b == delim:
+			return nil, &SyntaxError{Offset: d.offset - 1, Type: t, Expected: "digit", Found: b}
+		case isDigit(b), signed && (b == '-' || b == '+') && len(token) == 0:
+			token = append(token, b)
+		default:
+			return nil, &SyntaxError{Offset: d.offset - 1, Type: t, Expected: expected, Found: b}
+		}
+	}
+}
+
+// readN consumes exactly n bytes from the input.
+// The bytes are read through a limited reader rather than into a buffer of
+// size n, so a bogus length cannot make the decoder allocate it up front.
+func (d *Decoder) readN(n int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(d.reader, n))
+	d.offset += int64(len(data))
+	if d.rawDepth > 0 {
+		d.raw.Write(data)
+	}
+	if err != nil {
+		return nil, d.error(err)
+	}
+
+	if missing := n - int64(len(data)); missing > 0 {
+		return nil, &SyntaxError{Offset: d.offset, Type: TypeString, Expected: fmt.Sprintf("%d more bytes", missing), EOF: true}
+	}
+	return data, nil
+}
+
+// startRaw begins capturing the bytes consumed from the input and returns the
+// capture's start position. Captures nest, sharing a single buffer.
+func (d *Decoder) startRaw() int {
+	d.rawDepth++
+	return d.raw.Len()
+}
+
+// endRaw ends the capture begun at start and returns a copy of its bytes.
+func (d *Decoder) endRaw(start int) []byte {
+	captured := bytes.Clone(d.raw.Bytes()[start:])
+	d.rawDepth--
+	if d.rawDepth == 0 {
+		d.raw.Reset()
+	}
+	return captured
+}
+
+// decodeRecorded decodes the value stored under key, recording its raw span.
+func (d *Decoder) decodeRecorded(key string) (interface{}, error) {
+	offset := d.offset
+	start := d.startRaw()
+	value, err := d.decodeValue()
+	captured := d.endRaw(start)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.rawSpans == nil {
+		d.rawSpans = make(map[string]RawSpan)
+	}
+	d.rawSpans[key] = RawSpan{Offset: offset, Bytes: captured}
+	return value, nil
+}
+
+// unexpected converts an io.EOF hit in the middle of a value of type t into a
+// *SyntaxError reporting that expected was missing. Other read errors are
+// annotated with the current offset.
+func (d *Decoder) unexpected(err error, t Type, expected string) error {
+	if errors.Is(err, io.EOF) {
+		return &SyntaxError{Offset: d.offset, Type: t, Expected: expected, EOF: true}
+	}
+	return d.error(err)
+}
+
+// checkCanonical reports a *NonCanonicalError if strict mode is enabled and the
+// number token that started at offset is not written in canonical form.
+func (d *Decoder) checkCanonical(token []byte, offset int64, t Type) error {
+	if !d.strict {
+		return nil
+	}
+
+	var reason error
+	switch {
+	case len(token) > 0 && token[0] == '+':
+		reason = ErrPlusSign
+	case string(token) == "-0":
+		reason = ErrNegativeZero
+	case len(token) > 1 && token[0] == '0', bytes.HasPrefix(token, []byte("-0")):
+		reason = ErrLeadingZero
+	default:
+		return nil
+	}
+
+	return &NonCanonicalError{Offset: offset, Type: t, Err: reason}
+}
+
+// checkKeyOrder reports a *NonCanonicalError if strict mode is enabled and key,
+// found at offset, does not sort strictly after the previous key of its dictionary.
+func (d *Decoder) checkKeyOrder(prevKey, key []byte, offset int64) error {
+	if !d.strict || prevKey == nil {
+		return nil
+	}
+
+	switch cmp := bytes.Compare(prevKey, key); {
+	case cmp == 0:
+		return &NonCanonicalError{Offset: offset, Type: TypeDict, Err: ErrDuplicateKey}
+	case cmp > 0:
+		return &NonCanonicalError{Offset: offset, Type: TypeDict, Err: ErrUnsortedKeys}
+	}
+	return nil
+}
+
+// error annotates a read error with the current offset in the input.
+func (d *Decoder) error(err error) error {
+	return fmt.Errorf("%w at offset %d", err, d.offset)
 }
 
 // Decode decodes the next bencoded value from the input.
 // It determines the type of the value by peeking at the current character
 // and then delegates the decoding to the appropriate method.
+// Byte strings are returned as []byte, integers as int64 (or *big.Int, see SetBigInt), lists as []interface{}
+// and dictionaries as map[string]interface{}.
 //
-// Returns the decoded value as an interface{} and an error if the format is invalid.
+// Decode can be called repeatedly to read a sequence of concatenated values;
+// it returns io.EOF once the input is exhausted between two values.
 func (d *Decoder) Decode() (interface{}, error) {
-	if !d.hasMore() {
-		return nil, fmt.Errorf("unexpected end of input")
+	if _, err := d.reader.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	return d.decodeValue()
+}
+
+// decodeValue decodes a single value, treating the end of input as an error.
+func (d *Decoder) decodeValue() (interface{}, error) {
+	prefix, err := d.peekValue()
+	if err != nil {
+		return nil, err
 	}
 
-	switch d.peek() {
+	switch prefix {
 	case TypeInt.Prefix():
 		return d.decodeInt()
 	case TypeList.Prefix():
@@ -60,65 +291,116 @@ func (d *Decoder) Decode() (interface{}, error) {
 	}
 }
 
+// peekValue returns the first byte of the next value, which must be a type
+// prefix or the first digit of a string length.
+func (d *Decoder) peekValue() (byte, error) {
+	prefix, err := d.peek(TypeUnknown, "value")
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case prefix == TypeInt.Prefix(), prefix == TypeList.Prefix(), prefix == TypeDict.Prefix(), isDigit(prefix):
+		return prefix, nil
+	}
+	return 0, &SyntaxError{Offset: d.offset, Type: TypeUnknown, Expected: "value", Found: prefix}
+}
+
 // decodeInt decodes an integer from the bencoded input.
 // The integer is expected to be prefixed with 'i' and suffixed with 'e'.
-// For example, the bencoded integer "i123e" will be decoded to 123.
+// For example, the bencoded integer "i123e" will be decoded to int64(123).
+// Integers outside the int64 range are decoded to a *big.Int if big integers
+// are enabled, and are reported as an *OverflowError otherwise.
 //
 // Returns the decoded integer and an error if the format is invalid.
-func (d *Decoder) decodeInt() (int, error) {
-	if d.peek() != TypeInt.Prefix() {
-		return 0, MissingPrefix(TypeInt)
+func (d *Decoder) decodeInt() (interface{}, error) {
+	start := d.offset
+	numStr, err := d.decodeIntToken()
+	if err != nil {
+		return nil, err
+	}
+
+	num, err := strconv.ParseInt(numStr, 10, 64)
+	if err == nil {
+		return num, nil
 	}
 
-	d.moveNext() // consume 'i'
-	start := d.index
-	for d.hasMore() && d.peek() != 'e' {
-		d.moveNext()
+	if !d.useBigInt {
+		return nil, &OverflowError{Offset: start, Value: numStr, Kind: "int64"}
 	}
 
-	if !d.hasMore() {
-		return 0, MissingSuffix(TypeInt)
+	bigNum, _ := new(big.Int).SetString(numStr, 10)
+	return bigNum, nil
+}
+
+// decodeIntToken consumes a bencoded integer and returns its digits, checking
+// that they form a valid (and in strict mode, canonical) decimal number.
+func (d *Decoder) decodeIntToken() (string, error) {
+	if err := d.expect(TypeInt, TypeInt.Prefix()); err != nil {
+		return "", err
 	}
 
-	numStr := d.input[start:d.index]
-	d.moveNext() // consume 'e'
-	num, err := strconv.Atoi(numStr)
+	start := d.offset
+	numStr, err := d.readNumber(TypeInt, TypeInt.Suffix(), true)
 	if err != nil {
-		return 0, InvalidFormat(TypeInt)
+		return "", err
 	}
-	return num, nil
+
+	if err := d.checkCanonical(numStr, start, TypeInt); err != nil {
+		return "", err
+	}
+	return string(numStr), nil
 }
 
-// decodeString decodes a string from the bencoded input.
-// The string is expected to be prefixed with its length followed by a colon.
-// For example, the bencoded string "4:spam" will be decoded to "spam".
-//
-// Returns the decoded string and an error if the format is invalid.
-func (d *Decoder) decodeString() (string, error) {
-	start := d.index
-	for d.hasMore() && d.peek() != TypeString.Suffix() {
-		d.moveNext()
+// isDecimal reports whether token is an optionally signed, non-empty run of decimal digits.
+func isDecimal(token []byte) bool {
+	if len(token) > 0 && (token[0] == '-' || token[0] == '+') {
+		token = token[1:]
 	}
 
-	if !d.hasMore() {
-		return "", MissingSuffix(TypeString)
+	if len(token) == 0 {
+		return false
 	}
 
-	length := d.input[start:d.index]
-	d.moveNext() // consume ':'
+	for _, c := range token {
+		if !isDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDigit reports whether c is a decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
 
-	l, err := strconv.Atoi(length)
+// decodeString decodes a byte string from the bencoded input.
+// The string is expected to be prefixed with its length followed by a colon;
+// the length takes no sign. For example, the bencoded string "4:spam" will be decoded to []byte("spam").
+//
+// Returns the decoded bytes and an error if the format is invalid.
+func (d *Decoder) decodeString() ([]byte, error) {
+	start := d.offset
+	length, err := d.readNumber(TypeString, TypeString.Suffix(), false)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	l, err := strconv.ParseInt(string(length), 10, 64)
+	if err != nil {
+		return nil, &OverflowError{Offset: start, Value: string(length), Kind: "int64"}
+	}
+
+	if err := d.checkCanonical(length, start, TypeString); err != nil {
+		return nil, err
 	}
 
-	if d.index+l > len(d.input) {
-		return "", StringOutOfBounds
+	if err := d.checkStringLength(l); err != nil {
+		return nil, err
 	}
 
-	str := d.input[d.index : d.index+l]
-	d.move(l)
-	return str, nil
+	return d.readN(l)
 }
 
 // decodeList decodes a list from the bencoded input.
@@ -128,27 +410,39 @@ func (d *Decoder) decodeString() (string, error) {
 //
 // Returns the decoded list and an error if the format is invalid.
 func (d *Decoder) decodeList() ([]interface{}, error) {
-	if d.peek() != TypeList.Prefix() {
-		return nil, MissingPrefix(TypeList)
+	start := d.offset
+	if err := d.expect(TypeList, TypeList.Prefix()); err != nil {
+		return nil, err
 	}
 
-	d.moveNext() // consume 'l'
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
 
 	var list []interface{}
-	for d.hasMore() && d.peek() != TypeList.Suffix() {
-		item, err := d.Decode()
+	for {
+		b, err := d.peek(TypeList, "'e' or value")
 		if err != nil {
 			return nil, err
 		}
-		list = append(list, item)
-	}
 
-	if !d.hasMore() {
-		return nil, MissingSuffix(TypeList)
+		if b == TypeList.Suffix() {
+			break
+		}
+
+		if err := d.checkElements(len(list)+1, start); err != nil {
+			return nil, err
+		}
+
+		item, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
 	}
 
-	d.moveNext()
-	return list, nil
+	return list, d.expect(TypeList, TypeList.Suffix())
 }
 
 // decodeDict decodes a dictionary from the bencoded input.
@@ -157,31 +451,57 @@ func (d *Decoder) decodeList() ([]interface{}, error) {
 //
 // Returns the decoded dictionary and an error if the format is invalid.
 func (d *Decoder) decodeDict() (map[string]interface{}, error) {
-	if d.peek() != TypeDict.Prefix() {
-		return nil, MissingPrefix(TypeDict)
+	start := d.offset
+	if err := d.expect(TypeDict, TypeDict.Prefix()); err != nil {
+		return nil, err
 	}
 
-	d.moveNext()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
 
 	dict := make(map[string]interface{})
-	for d.hasMore() && d.peek() != TypeDict.Suffix() {
-		key, err := d.decodeString()
+	var prevKey []byte
+	count := 0
+	for {
+		b, err := d.peek(TypeDict, "'e' or key")
 		if err != nil {
 			return nil, err
 		}
 
-		value, err := d.Decode()
+		if b == TypeDict.Suffix() {
+			break
+		}
+
+		count++
+		if err := d.checkElements(count, start); err != nil {
+			return nil, err
+		}
+
+		keyOffset := d.offset
+		key, err := d.decodeString()
 		if err != nil {
 			return nil, err
 		}
 
-		dict[key] = value
-	}
+		if err := d.checkKeyOrder(prevKey, key, keyOffset); err != nil {
+			return nil, err
+		}
+		prevKey = key
+
+		var value interface{}
+		if d.depth == 1 && d.rawKeys[string(key)] {
+			value, err = d.decodeRecorded(string(key))
+		} else {
+			value, err = d.decodeValue()
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	if !d.hasMore() {
-		return nil, MissingSuffix(TypeDict)
+		dict[string(key)] = value
 	}
-	d.moveNext()
 
-	return dict, nil
+	return dict, d.expect(TypeDict, TypeDict.Suffix())
 }
@@ -0,0 +1,73 @@
+package bencode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecoderStrict(t *testing.T) {
+	tests := []struct {
+		input string
+		want  error // nil if the input is canonical
+	}{
+		{"i42e", nil},
+		{"i-42e", nil},
+		{"i0e", nil},
+		{"4:spam", nil},
+		{"0:", nil},
+		{"d1:ai1e1:bi2ee", nil},
+		{"i042e", ErrLeadingZero},
+		{"i-042e", ErrLeadingZero},
+		{"04:spam", ErrLeadingZero},
+		{"i-0e", ErrNegativeZero},
+		{"i+42e", ErrPlusSign},
+		{"d1:bi2e1:ai1ee", ErrUnsortedKeys},
+		{"d1:ai1e1:ai2ee", ErrDuplicateKey},
+		{"ld1:bi1e1:ai1eee", ErrUnsortedKeys},
+	}
+
+	for _, tt := range tests {
+		d := NewDecoder(strings.NewReader(tt.input))
+		d.SetStrict(true)
+		_, err := d.Decode()
+
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("Decode(%q) in strict mode: %v", tt.input, err)
+			}
+			continue
+		}
+
+		var nonCanonical *NonCanonicalError
+		if !errors.As(err, &nonCanonical) || !errors.Is(err, tt.want) {
+			t.Errorf("Decode(%q) in strict mode = %v, want a *NonCanonicalError wrapping %v", tt.input, err, tt.want)
+		}
+
+		// Without strict mode, the same input decodes.
+		if _, err := NewDecoder(strings.NewReader(tt.input)).Decode(); err != nil {
+			t.Errorf("Decode(%q): %v", tt.input, err)
+		}
+	}
+}
+
+func TestDecoderSignedStringLength(t *testing.T) {
+	for _, input := range []string{"+3:abc", "-3:abc", "d+3:abci1ee", "d-3:abci1ee", "l+0:e", "+:"} {
+		for _, strict := range []bool{false, true} {
+			d := NewDecoder(strings.NewReader(input))
+			d.SetStrict(strict)
+			_, err := d.Decode()
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Errorf("Decode(%q) with strict %v = %v, want a *SyntaxError", input, strict, err)
+			}
+		}
+
+		var v interface{}
+		var syntaxErr *SyntaxError
+		if err := Unmarshal([]byte(input), &v); !errors.As(err, &syntaxErr) {
+			t.Errorf("Unmarshal(%q) = %v, want a *SyntaxError", input, err)
+		}
+	}
+}
@@ -0,0 +1,678 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDHTTimeout   = 2 * time.Second
+	dhtTokenRotation    = 5 * time.Minute
+	dhtPeerExpiry       = 30 * time.Minute
+	dhtSweepInterval    = 5 * time.Minute // time between sweeps of expired peers and items
+	dhtMaxValues        = 50              // peers returned by one get_peers response
+	dhtMaxPeersPerHash  = 500             // peers stored per info hash; the oldest makes way for a new one
+	dhtMaxStoredPeers   = 20000           // peers stored in total; more announces are ignored
+	dhtMaxPacketSize    = 64 * 1024
+	dhtTokenSize        = 8
+	dhtTransactionBytes = 4 // random, so that off-path nodes cannot guess them
+)
+
+// DefaultBootstrapNodes are the well-known routers new DHT nodes join through.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// KRPC error codes (BEP 5).
+const (
+	KRPCGenericError  = 201
+	KRPCServerError   = 202
+	KRPCProtocolError = 203
+	KRPCMethodUnknown = 204
+	KRPCValueTooBig   = 205 // BEP 44
+	KRPCBadSignature  = 206
+	KRPCSaltTooBig    = 207
+	KRPCCasMismatch   = 301
+	KRPCSeqTooLow     = 302
+)
+
+// krpcMessage is a KRPC message: a query ("q"), response ("r") or error ("e").
+type krpcMessage struct {
+	T  []byte        `bencode:"t"`
+	Y  string        `bencode:"y"`
+	Q  string        `bencode:"q,omitempty"`
+	A  *krpcArgs     `bencode:"a,omitempty"`
+	R  *krpcReturn   `bencode:"r,omitempty"`
+	E  []interface{} `bencode:"e,omitempty"`
+	IP []byte        `bencode:"ip,omitempty"` // compact address of the querying node, in responses (BEP 42)
+}
+
+// krpcArgs holds the arguments of every query this node sends or answers.
+type krpcArgs struct {
+	ID          []byte     `bencode:"id"`
+	Target      []byte     `bencode:"target,omitempty"`
+	InfoHash    []byte     `bencode:"info_hash,omitempty"`
+	Port        int64      `bencode:"port,omitempty"`
+	ImpliedPort bool       `bencode:"implied_port,omitempty"`
+	Token       []byte     `bencode:"token,omitempty"`
+	V           RawMessage `bencode:"v,omitempty"`    // item to put (BEP 44)
+	K           []byte     `bencode:"k,omitempty"`    // ed25519 public key of a mutable item
+	Salt        []byte     `bencode:"salt,omitempty"` // salt of a mutable item
+	Seq         *int64     `bencode:"seq,omitempty"`  // sequence number of a mutable item
+	Cas         *int64     `bencode:"cas,omitempty"`  // sequence number a put expects to replace
+	Sig         []byte     `bencode:"sig,omitempty"`  // signature of a mutable item
+}
+
+// krpcReturn holds the return values of every response this node sends or reads.
+type krpcReturn struct {
+	ID     []byte     `bencode:"id"`
+	Nodes  []byte     `bencode:"nodes,omitempty"`
+	Nodes6 []byte     `bencode:"nodes6,omitempty"`
+	Token  []byte     `bencode:"token,omitempty"`
+	Values [][]byte   `bencode:"values,omitempty"`
+	V      RawMessage `bencode:"v,omitempty"`
+	K      []byte     `bencode:"k,omitempty"`
+	Seq    *int64     `bencode:"seq,omitempty"`
+	Sig    []byte     `bencode:"sig,omitempty"`
+}
+
+// DHTConfig configures a DHT node.
+type DHTConfig struct {
+	Addr           string        // UDP address to listen on; empty picks any port
+	BootstrapNodes []string      // nodes to join the DHT through, in the format "host:port"
+	StateFile      string        // file the routing table is loaded from and saved to; empty disables persistence
+	Timeout        time.Duration // how long to wait for an answer to a query; zero uses two seconds
+	InsecureIDs    bool          // accept nodes whose ID does not match their IP (BEP 42)
+}
+
+// DHT is a node of the mainline DHT (BEP 5). It answers the queries of other
+// nodes as soon as it is created, and finds peers for info hashes through
+// iterative lookups over its routing table.
+type DHT struct {
+	conn    net.PacketConn
+	config  DHTConfig
+	closing chan struct{}
+	done    chan struct{}
+
+	mu        sync.Mutex
+	pending   map[string]*dhtQuery            // outstanding queries by transaction id
+	peers     map[NodeID]map[string]time.Time // announced peers by info hash
+	peerCount int                             // peers stored in peers, over every info hash
+	secrets   [2][]byte                       // current and previous token secrets
+	rotatedAt time.Time
+	items     map[NodeID]*dhtItem        // items stored with put (BEP 44) by target
+	ipVotes   map[string]map[string]bool // IPs of the nodes that reported each external IP (BEP 42)
+
+	idMu  sync.RWMutex
+	id    NodeID
+	table *routingTable
+}
+
+// dhtQuery is a query waiting for its response.
+type dhtQuery struct {
+	addr     *net.UDPAddr      // node the query was sent to; only it may answer
+	response chan *krpcMessage // receives the response or error
+}
+
+// dhtState is the routing table as saved to DHTConfig.StateFile.
+type dhtState struct {
+	ID     []byte `bencode:"id"`
+	Nodes  []byte `bencode:"nodes,omitempty"`
+	Nodes6 []byte `bencode:"nodes6,omitempty"`
+}
+
+// NewDHT starts a DHT node listening on cfg.Addr. If cfg.StateFile holds a
+// saved routing table, the node takes back its ID and nodes from it.
+//
+// Parameters:
+// - cfg: A DHTConfig struct describing the node.
+//
+// Returns:
+// - A pointer to the running DHT node.
+// - An error if the node cannot listen or the state file is malformed.
+func NewDHT(cfg DHTConfig) (*DHT, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultDHTTimeout
+	}
+
+	d := &DHT{
+		config:  cfg,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[string]*dhtQuery),
+		peers:   make(map[NodeID]map[string]time.Time),
+		items:   make(map[NodeID]*dhtItem),
+		ipVotes: make(map[string]map[string]bool),
+	}
+
+	state, err := loadDHTState(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if state != nil && len(state.ID) == len(d.id) {
+		copy(d.id[:], state.ID)
+	} else if d.id, err = RandomNodeID(); err != nil {
+		return nil, err
+	}
+
+	d.table = newRoutingTable(d.id)
+	if state != nil {
+		nodes, _ := decodeCompactNodes(state.Nodes, net.IPv4len)
+		nodes6, _ := decodeCompactNodes(state.Nodes6, net.IPv6len)
+		for _, node := range append(nodes, nodes6...) {
+			d.addNode(node, false)
+		}
+	}
+
+	if err := d.rotateSecrets(); err != nil {
+		return nil, err
+	}
+
+	addr := cfg.Addr
+	if addr == "" {
+		addr = ":0"
+	}
+
+	d.conn, err = net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go d.serve()
+	go d.sweep()
+	return d, nil
+}
+
+// ID returns the node's ID.
+func (d *DHT) ID() NodeID {
+	d.idMu.RLock()
+	defer d.idMu.RUnlock()
+	return d.id
+}
+
+// routes returns the node's routing table.
+func (d *DHT) routes() *routingTable {
+	d.idMu.RLock()
+	defer d.idMu.RUnlock()
+	return d.table
+}
+
+// addNode adds a node to the routing table, unless its ID does not match its
+// IP (BEP 42) and insecure IDs are not accepted.
+func (d *DHT) addNode(node Node, seen bool) {
+	if !d.config.InsecureIDs && !ValidNodeID(node.ID, node.Addr.IP) {
+		return
+	}
+	d.routes().insert(node, seen)
+}
+
+// Addr returns the UDP address the node listens on.
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// Nodes returns every node in the routing table.
+func (d *DHT) Nodes() []Node {
+	return d.routes().nodes()
+}
+
+// Close stops the node and saves its routing table to the state file, if one is configured.
+func (d *DHT) Close() error {
+	close(d.closing)
+	err := d.conn.Close()
+	<-d.done
+
+	if saveErr := d.SaveState(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// SaveState saves the node's ID and routing table to the state file, if one
+// is configured.
+func (d *DHT) SaveState() error {
+	if d.config.StateFile == "" {
+		return nil
+	}
+
+	id := d.ID()
+	state := dhtState{ID: id[:]}
+	state.Nodes, state.Nodes6 = encodeCompactNodes(d.Nodes())
+
+	data, err := Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.config.StateFile), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated table behind.
+	tmp := d.config.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.config.StateFile)
+}
+
+// loadDHTState reads a saved routing table. A missing file is not an error.
+func loadDHTState(path string) (*dhtState, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state dhtState
+	if err := Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error loading DHT state from %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// serve reads incoming packets until the node is closed, answering queries
+// and handing responses to the queries waiting for them.
+func (d *DHT) serve() {
+	defer close(d.done)
+
+	buf := make([]byte, dhtMaxPacketSize)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.closing:
+				return
+			default:
+				continue
+			}
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		var msg krpcMessage
+		if err := unmarshalLimited(buf[:n], &msg, krpcLimits); err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			d.handleQuery(&msg, addr)
+		case "r", "e":
+			d.handleResponse(&msg, addr)
+		}
+	}
+}
+
+// handleResponse hands a response or error to the query waiting for it.
+// Messages that do not come from the node the query was sent to are dropped.
+func (d *DHT) handleResponse(msg *krpcMessage, addr *net.UDPAddr) {
+	d.mu.Lock()
+	q, ok := d.pending[string(msg.T)]
+	if ok && (!q.addr.IP.Equal(addr.IP) || q.addr.Port != addr.Port) {
+		ok = false
+	}
+	if ok {
+		delete(d.pending, string(msg.T))
+	}
+	d.mu.Unlock()
+
+	if ok {
+		q.response <- msg
+	}
+}
+
+// handleQuery answers a query from another node.
+func (d *DHT) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	id := d.ID()
+	if msg.A == nil || len(msg.A.ID) != len(id) {
+		d.sendError(msg.T, addr, KRPCProtocolError, "missing or invalid id")
+		return
+	}
+
+	var sender Node
+	copy(sender.ID[:], msg.A.ID)
+	sender.Addr = addr
+	d.addNode(sender, true)
+
+	r := &krpcReturn{ID: id[:]}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		var target NodeID
+		if len(msg.A.Target) != len(target) {
+			d.sendError(msg.T, addr, KRPCProtocolError, "invalid target")
+			return
+		}
+		copy(target[:], msg.A.Target)
+		r.Nodes, r.Nodes6 = encodeCompactNodes(d.routes().closest(target, dhtK))
+	case "get_peers":
+		var infoHash NodeID
+		if len(msg.A.InfoHash) != len(infoHash) {
+			d.sendError(msg.T, addr, KRPCProtocolError, "invalid info_hash")
+			return
+		}
+		copy(infoHash[:], msg.A.InfoHash)
+
+		r.Token = d.token(addr.IP, 0)
+		if values := d.storedPeers(infoHash); len(values) > 0 {
+			r.Values = values
+		} else {
+			r.Nodes, r.Nodes6 = encodeCompactNodes(d.routes().closest(infoHash, dhtK))
+		}
+	case "announce_peer":
+		var infoHash NodeID
+		if len(msg.A.InfoHash) != len(infoHash) {
+			d.sendError(msg.T, addr, KRPCProtocolError, "invalid info_hash")
+			return
+		}
+		copy(infoHash[:], msg.A.InfoHash)
+
+		if !d.validToken(msg.A.Token, addr.IP) {
+			d.sendError(msg.T, addr, KRPCProtocolError, "bad token")
+			return
+		}
+
+		port := int(msg.A.Port)
+		if msg.A.ImpliedPort {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(msg.T, addr, KRPCProtocolError, "invalid port")
+			return
+		}
+		d.storePeer(infoHash, &net.UDPAddr{IP: addr.IP, Port: port})
+	case "get":
+		var target NodeID
+		if len(msg.A.Target) != len(target) {
+			d.sendError(msg.T, addr, KRPCProtocolError, "invalid target")
+			return
+		}
+		copy(target[:], msg.A.Target)
+
+		r.Token = d.token(addr.IP, 0)
+		r.Nodes, r.Nodes6 = encodeCompactNodes(d.routes().closest(target, dhtK))
+		if item := d.storedItem(target); item != nil {
+			item.fill(r, msg.A.Seq)
+		}
+	case "put":
+		if !d.validToken(msg.A.Token, addr.IP) {
+			d.sendError(msg.T, addr, KRPCProtocolError, "bad token")
+			return
+		}
+
+		if err := d.storeItem(msg.A); err != nil {
+			d.sendError(msg.T, addr, err.Code, err.Message)
+			return
+		}
+	default:
+		d.sendError(msg.T, addr, KRPCMethodUnknown, "method unknown")
+		return
+	}
+
+	d.send(&krpcMessage{T: msg.T, Y: "r", R: r, IP: compactAddr(addr)}, addr)
+}
+
+// send writes a KRPC message to addr.
+func (d *DHT) send(msg *krpcMessage, addr *net.UDPAddr) error {
+	data, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteTo(data, addr)
+	return err
+}
+
+// sendError answers a query with a KRPC error.
+func (d *DHT) sendError(t []byte, addr *net.UDPAddr, code int64, message string) {
+	d.send(&krpcMessage{T: t, Y: "e", E: []interface{}{code, message}}, addr)
+}
+
+// query sends a query to the node at addr and waits for its response. The
+// responding node is added to the routing table; a node that does not answer
+// in time is marked as failed.
+//
+// Parameters:
+// - addr: The UDP address of the node.
+// - method: The name of the query, such as "ping" or "get_peers".
+// - args: The arguments of the query; the node's own ID is filled in.
+//
+// Returns:
+// - A pointer to the return values of the response.
+// - A *KRPCError if the node answered with an error, or an error on timeout.
+func (d *DHT) query(addr *net.UDPAddr, method string, args krpcArgs) (*krpcReturn, error) {
+	id := d.ID()
+	args.ID = id[:]
+
+	t := make([]byte, dhtTransactionBytes)
+	ch := make(chan *krpcMessage, 1)
+	d.mu.Lock()
+	for {
+		if _, err := rand.Read(t); err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+		if _, taken := d.pending[string(t)]; !taken {
+			break
+		}
+	}
+	d.pending[string(t)] = &dhtQuery{addr: addr, response: ch}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, string(t))
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(&krpcMessage{T: t, Y: "q", Q: method, A: &args}, addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(d.config.Timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-ch:
+		if msg.Y == "e" {
+			return nil, newKRPCError(msg.E)
+		}
+
+		if msg.R == nil || len(msg.R.ID) != len(id) {
+			return nil, fmt.Errorf("invalid response from %s", addr)
+		}
+
+		var node Node
+		copy(node.ID[:], msg.R.ID)
+		node.Addr = addr
+		d.addNode(node, true)
+		d.voteExternalAddr(msg.IP, addr)
+		return msg.R, nil
+	case <-timer.C:
+		d.routes().failed(addr)
+		return nil, fmt.Errorf("query %s to %s timed out", method, addr)
+	case <-d.closing:
+		return nil, net.ErrClosed
+	}
+}
+
+// newKRPCError builds a *KRPCError from the "e" list of an error message.
+func newKRPCError(e []interface{}) *KRPCError {
+	err := &KRPCError{Code: KRPCGenericError}
+	if len(e) > 0 {
+		if code, ok := e[0].(int64); ok {
+			err.Code = code
+		}
+	}
+	if len(e) > 1 {
+		if message, ok := e[1].([]byte); ok {
+			err.Message = string(message)
+		}
+	}
+	return err
+}
+
+// rotateSecrets starts a new token secret, keeping the previous one so that
+// tokens handed out shortly before stay valid.
+func (d *DHT) rotateSecrets() error {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	d.secrets[1] = d.secrets[0]
+	d.secrets[0] = secret
+	d.rotatedAt = time.Now()
+	return nil
+}
+
+// token returns the announce token for ip under one of the token secrets,
+// rotating the secrets when they are due.
+func (d *DHT) token(ip net.IP, secret int) []byte {
+	d.mu.Lock()
+	if time.Since(d.rotatedAt) > dhtTokenRotation {
+		d.rotateSecrets()
+	}
+	key := d.secrets[secret]
+	d.mu.Unlock()
+
+	if key == nil {
+		return nil
+	}
+
+	h := sha1.New()
+	h.Write(key)
+	h.Write(ip)
+	return h.Sum(nil)[:dhtTokenSize]
+}
+
+// validToken reports whether token was handed out to ip by this node recently.
+func (d *DHT) validToken(token []byte, ip net.IP) bool {
+	for secret := range d.secrets {
+		if expected := d.token(ip, secret); expected != nil && bytes.Equal(token, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// storePeer records a peer announced for infoHash. Once dhtMaxPeersPerHash
+// peers are stored for infoHash, the one that announced longest ago is
+// forgotten to make room; once dhtMaxStoredPeers are stored in total, new
+// peers are ignored.
+func (d *DHT) storePeer(infoHash NodeID, addr *net.UDPAddr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := addr.String()
+	peers := d.peers[infoHash]
+	if _, ok := peers[key]; !ok {
+		if len(peers) >= dhtMaxPeersPerHash {
+			var oldest string
+			for peer, announcedAt := range peers {
+				if oldest == "" || announcedAt.Before(peers[oldest]) {
+					oldest = peer
+				}
+			}
+			delete(peers, oldest)
+			d.peerCount--
+		} else if d.peerCount >= dhtMaxStoredPeers {
+			return
+		}
+
+		if peers == nil {
+			peers = make(map[string]time.Time)
+			d.peers[infoHash] = peers
+		}
+		d.peerCount++
+	}
+	peers[key] = time.Now()
+}
+
+// sweep forgets expired peers and items every dhtSweepInterval until the
+// node is closed.
+func (d *DHT) sweep() {
+	ticker := time.NewTicker(dhtSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.expirePeers()
+			d.expireItems()
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+// expirePeers forgets the peers of every info hash that have not announced
+// again in time.
+func (d *DHT) expirePeers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for infoHash := range d.peers {
+		d.expirePeersOf(infoHash)
+	}
+}
+
+// expirePeersOf forgets the peers of infoHash that have not announced again
+// in time. d.mu must be held.
+func (d *DHT) expirePeersOf(infoHash NodeID) {
+	peers := d.peers[infoHash]
+	for addr, announcedAt := range peers {
+		if time.Since(announcedAt) > dhtPeerExpiry {
+			delete(peers, addr)
+			d.peerCount--
+		}
+	}
+	if len(peers) == 0 {
+		delete(d.peers, infoHash)
+	}
+}
+
+// storedPeers returns the peers announced for infoHash in compact form,
+// forgetting those that have not announced again in time.
+func (d *DHT) storedPeers(infoHash NodeID) [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expirePeersOf(infoHash)
+
+	var values [][]byte
+	for addr := range d.peers[infoHash] {
+		if len(values) == dhtMaxValues {
+			break
+		}
+
+		v4, v6 := encodeCompactPeers([]string{addr})
+		if len(v4) > 0 {
+			values = append(values, v4)
+		} else if len(v6) > 0 {
+			values = append(values, v6)
+		}
+	}
+	return values
+}
@@ -0,0 +1,311 @@
+package bencode
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const dhtAlpha = 3 // queries a lookup keeps in flight
+
+// lookupResult is the outcome of an iterative lookup.
+type lookupResult struct {
+	nodes  []Node            // closest nodes that answered, closest first
+	tokens map[NodeID][]byte // announce and put tokens handed out by those nodes
+	peers  []string          // peers returned by get_peers, without duplicates
+	items  []*krpcReturn     // responses to get holding an item, not yet verified
+}
+
+// lookup walks the DHT towards target: it queries the closest nodes it knows
+// of, dhtAlpha at a time, learns closer nodes from their answers and stops
+// once the dhtK closest nodes it has heard of have all been queried.
+//
+// Parameters:
+// - target: The node ID or info hash to look up.
+// - method: "find_node", "get_peers" or "get".
+//
+// Returns:
+// - A pointer to a lookupResult holding the closest nodes and, for get_peers and get, the peers or items found.
+// - An error if the routing table is empty.
+func (d *DHT) lookup(target NodeID, method string) (*lookupResult, error) {
+	self := d.ID()
+	candidates := d.routes().closest(target, dhtK)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("routing table is empty")
+	}
+
+	args := krpcArgs{Target: target[:]}
+	if method == "get_peers" {
+		args = krpcArgs{InfoHash: target[:]}
+	}
+
+	result := &lookupResult{tokens: make(map[NodeID][]byte)}
+	seen := make(map[string]bool)
+	queried := make(map[string]bool)
+	seenPeers := make(map[string]bool)
+	for _, node := range candidates {
+		seen[node.Addr.String()] = true
+	}
+
+	var mu sync.Mutex
+	for {
+		sortByDistance(candidates, target)
+
+		var batch []Node
+		for _, node := range candidates[:min(len(candidates), dhtK)] {
+			if !queried[node.Addr.String()] && len(batch) < dhtAlpha {
+				batch = append(batch, node)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var failed []string
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			queried[node.Addr.String()] = true
+
+			wg.Add(1)
+			go func(node Node) {
+				defer wg.Done()
+				r, err := d.query(node.Addr, method, args)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed = append(failed, node.Addr.String())
+					return
+				}
+
+				copy(node.ID[:], r.ID)
+				result.nodes = append(result.nodes, node)
+				if r.Token != nil {
+					result.tokens[node.ID] = r.Token
+				}
+				if r.V != nil || r.Seq != nil {
+					result.items = append(result.items, r)
+				}
+
+				for _, value := range r.Values {
+					ipSize := net.IPv4len
+					if len(value) == compactV6Size {
+						ipSize = net.IPv6len
+					}
+
+					peers, err := decodeCompactPeers(value, ipSize)
+					if err != nil {
+						continue
+					}
+
+					for _, peer := range peers {
+						if !seenPeers[peer] {
+							seenPeers[peer] = true
+							result.peers = append(result.peers, peer)
+						}
+					}
+				}
+
+				nodes, _ := decodeCompactNodes(r.Nodes, net.IPv4len)
+				nodes6, _ := decodeCompactNodes(r.Nodes6, net.IPv6len)
+				for _, n := range append(nodes, nodes6...) {
+					if n.ID == self || seen[n.Addr.String()] {
+						continue
+					}
+					seen[n.Addr.String()] = true
+					candidates = append(candidates, n)
+				}
+			}(node)
+		}
+		wg.Wait()
+
+		// Nodes that did not answer make room for the next closest ones.
+		dropped := make(map[string]bool, len(failed))
+		for _, addr := range failed {
+			dropped[addr] = true
+		}
+		kept := candidates[:0]
+		for _, node := range candidates {
+			if !dropped[node.Addr.String()] {
+				kept = append(kept, node)
+			}
+		}
+		candidates = kept
+	}
+
+	sortByDistance(result.nodes, target)
+	result.nodes = result.nodes[:min(len(result.nodes), dhtK)]
+	return result, nil
+}
+
+// Bootstrap joins the DHT: it asks the configured bootstrap nodes, or
+// DefaultBootstrapNodes if none are configured, for the nodes closest to our
+// own ID, then looks up our own ID to fill the routing table. Nodes loaded
+// from the state file are used as well.
+//
+// Returns:
+// - An error if no node could be reached.
+func (d *DHT) Bootstrap() error {
+	self := d.ID()
+	bootstrap := d.config.BootstrapNodes
+	if bootstrap == nil {
+		bootstrap = DefaultBootstrapNodes
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range bootstrap {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			r, err := d.query(addr, "find_node", krpcArgs{Target: self[:]})
+			if err != nil {
+				return
+			}
+
+			nodes, _ := decodeCompactNodes(r.Nodes, net.IPv4len)
+			nodes6, _ := decodeCompactNodes(r.Nodes6, net.IPv6len)
+			for _, node := range append(nodes, nodes6...) {
+				d.addNode(node, false)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if _, err := d.lookup(self, "find_node"); err != nil {
+		return fmt.Errorf("error bootstrapping DHT: %w", err)
+	}
+	return nil
+}
+
+// Ping pings the node at addr and adds it to the routing table if it answers.
+//
+// Parameters:
+// - addr: The address of the node in the format "host:port".
+//
+// Returns:
+// - The ID of the node.
+// - An error if the node does not answer.
+func (d *DHT) Ping(addr string) (NodeID, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	r, err := d.query(udpAddr, "ping", krpcArgs{})
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	var id NodeID
+	copy(id[:], r.ID)
+	return id, nil
+}
+
+// FindNode looks up the nodes closest to target.
+//
+// Parameters:
+// - target: The node ID to look up.
+//
+// Returns:
+// - Up to eight of the closest nodes that answered, closest first.
+// - An error if the routing table is empty.
+func (d *DHT) FindNode(target NodeID) ([]Node, error) {
+	result, err := d.lookup(target, "find_node")
+	if err != nil {
+		return nil, err
+	}
+	return result.nodes, nil
+}
+
+// GetPeers looks up the peers of a torrent.
+//
+// Parameters:
+// - infoHash: The info hash of the torrent.
+//
+// Returns:
+// - A slice of strings, each representing a peer in the format "IP:port".
+// - An error if the routing table is empty.
+func (d *DHT) GetPeers(infoHash NodeID) ([]string, error) {
+	result, err := d.lookup(infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+	return result.peers, nil
+}
+
+// AnnouncePeer announces that we are a peer of a torrent to the nodes closest
+// to its info hash, using the tokens they handed out during the lookup.
+//
+// Parameters:
+// - infoHash: The info hash of the torrent.
+// - port: The port peers can reach us on; zero asks nodes to use the UDP port of this node.
+//
+// Returns:
+// - The peers found while looking up the info hash.
+// - An error if no node accepted the announce.
+func (d *DHT) AnnouncePeer(infoHash NodeID, port int) ([]string, error) {
+	result, err := d.lookup(infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+
+	args := krpcArgs{InfoHash: infoHash[:], Port: int64(port), ImpliedPort: port == 0}
+	if port == 0 {
+		if addr, ok := d.Addr().(*net.UDPAddr); ok {
+			args.Port = int64(addr.Port)
+		}
+	}
+
+	return result.peers, d.sendWithTokens(result, "announce_peer", args)
+}
+
+// sendWithTokens sends a query that needs a token, such as announce_peer or
+// put, to the nodes closest to the target of a lookup, using the tokens they
+// handed out during the lookup.
+//
+// Parameters:
+// - result: A pointer to the lookupResult of a get_peers or get lookup.
+// - method: The name of the query.
+// - args: The arguments of the query; the token of each node is filled in.
+//
+// Returns:
+// - An error if no node accepted the query.
+func (d *DHT) sendWithTokens(result *lookupResult, method string, args krpcArgs) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	lastErr := fmt.Errorf("no node handed out a token")
+	for _, node := range result.nodes {
+		token, ok := result.tokens[node.ID]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node Node, args krpcArgs) {
+			defer wg.Done()
+			args.Token = token
+			_, err := d.query(node.Addr, method, args)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			accepted++
+		}(node, args)
+	}
+	wg.Wait()
+
+	if accepted == 0 {
+		return lastErr
+	}
+	return nil
+}
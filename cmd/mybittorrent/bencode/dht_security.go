@@ -0,0 +1,137 @@
+package bencode
+
+import (
+	"hash/crc32"
+	"net"
+)
+
+const dhtIPVotes = 3 // nodes that must report the same external IP before we trust it
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// Masks applied to the leading bytes of an IP before hashing it into a node ID (BEP 42).
+	nodeIDMaskV4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	nodeIDMaskV6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// nodeIDPrefix returns the CRC32-C of the masked IP, combined with the three
+// random bits r, that the first 21 bits of a secure node ID must match.
+func nodeIDPrefix(ip net.IP, r byte) uint32 {
+	mask := nodeIDMaskV6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, nodeIDMaskV4
+	}
+
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= (r & 0x07) << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// SecureNodeID returns a random node ID that nodes enforcing BEP 42 accept
+// from a node reachable at ip.
+//
+// Parameters:
+// - ip: The external IP of the node.
+//
+// Returns:
+// - The node ID.
+// - An error if no random bytes could be read.
+func SecureNodeID(ip net.IP) (NodeID, error) {
+	id, err := RandomNodeID()
+	if err != nil {
+		return id, err
+	}
+
+	crc := nodeIDPrefix(ip, id[19])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return id, nil
+}
+
+// ValidNodeID reports whether id is a node ID a node reachable at ip may use
+// (BEP 42). Nodes on loopback, private and link-local addresses may use any ID.
+func ValidNodeID(id NodeID, ip net.IP) bool {
+	if isLocalIP(ip) {
+		return true
+	}
+
+	crc := nodeIDPrefix(ip, id[19])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && (id[2]^byte(crc>>8))&0xf8 == 0
+}
+
+// isLocalIP reports whether ip is exempt from BEP 42 because it is not
+// routable on the internet.
+func isLocalIP(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// compactAddr encodes addr as a compact peer address, as sent back in the
+// "ip" key of KRPC responses.
+func compactAddr(addr *net.UDPAddr) []byte {
+	v4, v6 := encodeCompactPeers([]string{addr.String()})
+	if len(v4) > 0 {
+		return v4
+	}
+	return v6
+}
+
+// voteExternalAddr counts a node reporting our external address in the "ip"
+// key of a response. Once enough nodes agree on an address our ID is not
+// valid for, the node switches to a secure ID for it.
+func (d *DHT) voteExternalAddr(ip []byte, voter *net.UDPAddr) {
+	ipSize := net.IPv4len
+	if len(ip) == compactV6Size {
+		ipSize = net.IPv6len
+	}
+
+	addrs, err := decodeCompactPeers(ip, ipSize)
+	if err != nil || len(addrs) != 1 {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(addrs[0])
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	voters, ok := d.ipVotes[host]
+	if !ok {
+		voters = make(map[string]bool)
+		d.ipVotes[host] = voters
+	}
+	voters[voter.IP.String()] = true
+	agreed := len(voters) >= dhtIPVotes
+	if agreed {
+		d.ipVotes = make(map[string]map[string]bool)
+	}
+	d.mu.Unlock()
+
+	if external := net.ParseIP(host); agreed && !ValidNodeID(d.ID(), external) {
+		d.changeID(external)
+	}
+}
+
+// changeID switches the node to a secure ID for its external IP and rebuilds
+// the routing table around the new ID.
+func (d *DHT) changeID(external net.IP) {
+	id, err := SecureNodeID(external)
+	if err != nil {
+		return
+	}
+
+	table := newRoutingTable(id)
+	for _, node := range d.Nodes() {
+		table.insert(node, false)
+	}
+
+	d.idMu.Lock()
+	d.id = id
+	d.table = table
+	d.idMu.Unlock()
+}
@@ -0,0 +1,287 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	dhtMaxItemSize = 1000 // bytes of the bencoded value of an item
+	dhtMaxSaltSize = 64
+	dhtItemExpiry  = 2 * time.Hour
+	dhtMaxItems    = 10000 // items stored at once; puts of new targets are refused beyond it
+)
+
+// dhtItem is an item stored in the DHT with put (BEP 44). Immutable items
+// are stored under the SHA-1 hash of their value; mutable items are signed
+// with an ed25519 key and stored under the SHA-1 hash of the key and salt.
+type dhtItem struct {
+	v        RawMessage // bencoded value
+	k        []byte     // public key; nil for immutable items
+	seq      int64
+	sig      []byte
+	storedAt time.Time
+}
+
+// MutableItem is a signed item read from the DHT.
+type MutableItem struct {
+	Key  ed25519.PublicKey
+	Salt []byte
+	Seq  int64      // sequence number; higher numbers replace lower ones
+	V    RawMessage // bencoded value
+	Sig  []byte
+}
+
+// ImmutableTarget returns the target an immutable item is stored under.
+//
+// Parameters:
+// - v: The bencoded value of the item.
+func ImmutableTarget(v []byte) NodeID {
+	return sha1.Sum(v)
+}
+
+// MutableTarget returns the target the mutable items signed with key are
+// stored under for the given salt.
+//
+// Parameters:
+// - key: The ed25519 public key the items are signed with.
+// - salt: The salt distinguishing several items signed with the same key; may be empty.
+func MutableTarget(key ed25519.PublicKey, salt []byte) NodeID {
+	return sha1.Sum(append(append([]byte(nil), key...), salt...))
+}
+
+// signedData returns the bytes a mutable item's signature covers: the
+// bencoded salt (if any), sequence number and value, as they would appear in
+// a dictionary but without the surrounding "d" and "e".
+func signedData(salt []byte, seq int64, v []byte) []byte {
+	var buf bytes.Buffer
+	if len(salt) > 0 {
+		buf.WriteString("4:salt" + strconv.Itoa(len(salt)) + ":")
+		buf.Write(salt)
+	}
+	buf.WriteString("3:seqi" + strconv.FormatInt(seq, 10) + "e1:v")
+	buf.Write(v)
+	return buf.Bytes()
+}
+
+// fill sets the return values of a get response to the item. A mutable item
+// not newer than seq is reported by its sequence number only.
+func (item *dhtItem) fill(r *krpcReturn, seq *int64) {
+	if item.k == nil {
+		r.V = item.v
+		return
+	}
+
+	r.Seq = &item.seq
+	if seq == nil || *seq < item.seq {
+		r.V, r.K, r.Sig = item.v, item.k, item.sig
+	}
+}
+
+// storedItem returns the item stored under target, forgetting it if it has
+// not been put again in time.
+func (d *DHT) storedItem(target NodeID) *dhtItem {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	item, ok := d.items[target]
+	if ok && time.Since(item.storedAt) > dhtItemExpiry {
+		delete(d.items, target)
+		return nil
+	}
+	return item
+}
+
+// storeItem validates the item of a put query and stores it.
+//
+// Parameters:
+// - a: The arguments of the put query.
+//
+// Returns:
+// - A *KRPCError to answer the query with if the item is rejected.
+func (d *DHT) storeItem(a *krpcArgs) *KRPCError {
+	if len(a.V) == 0 {
+		return &KRPCError{Code: KRPCProtocolError, Message: "missing v"}
+	}
+	if len(a.V) > dhtMaxItemSize {
+		return &KRPCError{Code: KRPCValueTooBig, Message: "message (v field) too big"}
+	}
+
+	item := &dhtItem{v: a.V, storedAt: time.Now()}
+	if a.K == nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.putItem(ImmutableTarget(a.V), item)
+	}
+
+	if len(a.K) != ed25519.PublicKeySize || a.Seq == nil {
+		return &KRPCError{Code: KRPCProtocolError, Message: "invalid k or missing seq"}
+	}
+	if len(a.Salt) > dhtMaxSaltSize {
+		return &KRPCError{Code: KRPCSaltTooBig, Message: "salt (salt field) too big"}
+	}
+	if len(a.Sig) != ed25519.SignatureSize || !ed25519.Verify(a.K, signedData(a.Salt, *a.Seq, a.V), a.Sig) {
+		return &KRPCError{Code: KRPCBadSignature, Message: "invalid signature"}
+	}
+	item.k, item.seq, item.sig = a.K, *a.Seq, a.Sig
+
+	target := MutableTarget(a.K, a.Salt)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if current, ok := d.items[target]; ok {
+		if a.Cas != nil && *a.Cas != current.seq {
+			return &KRPCError{Code: KRPCCasMismatch, Message: "CAS mismatch, re-read value and try again"}
+		}
+		if *a.Seq < current.seq {
+			return &KRPCError{Code: KRPCSeqTooLow, Message: "sequence number less than current"}
+		}
+	}
+	return d.putItem(target, item)
+}
+
+// putItem stores item under target, unless the target is new and
+// dhtMaxItems items are stored already. d.mu must be held.
+func (d *DHT) putItem(target NodeID, item *dhtItem) *KRPCError {
+	if _, ok := d.items[target]; !ok && len(d.items) >= dhtMaxItems {
+		return &KRPCError{Code: KRPCServerError, Message: "storage full"}
+	}
+	d.items[target] = item
+	return nil
+}
+
+// expireItems forgets the items that have not been put again in time.
+func (d *DHT) expireItems() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for target, item := range d.items {
+		if time.Since(item.storedAt) > dhtItemExpiry {
+			delete(d.items, target)
+		}
+	}
+}
+
+// PutImmutable stores an immutable item on the nodes closest to its target.
+//
+// Parameters:
+// - v: The value of the item; it is bencoded with Marshal.
+//
+// Returns:
+// - The target the item can be read back with.
+// - An error if the value is too big or no node stored it.
+func (d *DHT) PutImmutable(v interface{}) (NodeID, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return NodeID{}, err
+	}
+	if len(data) > dhtMaxItemSize {
+		return NodeID{}, fmt.Errorf("item of %d bytes exceeds %d bytes", len(data), dhtMaxItemSize)
+	}
+
+	target := ImmutableTarget(data)
+	result, err := d.lookup(target, "get")
+	if err != nil {
+		return target, err
+	}
+	return target, d.sendWithTokens(result, "put", krpcArgs{V: data})
+}
+
+// GetImmutable reads an immutable item from the DHT.
+//
+// Parameters:
+// - target: The target returned by PutImmutable.
+//
+// Returns:
+// - The bencoded value of the item.
+// - An error if no node returned a value matching the target.
+func (d *DHT) GetImmutable(target NodeID) (RawMessage, error) {
+	result, err := d.lookup(target, "get")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range result.items {
+		if r.V != nil && ImmutableTarget(r.V) == target {
+			return r.V, nil
+		}
+	}
+	return nil, fmt.Errorf("item %s not found", target)
+}
+
+// PutMutable signs a mutable item and stores it on the nodes closest to its
+// target. Nodes keep the item with the highest sequence number.
+//
+// Parameters:
+// - key: The ed25519 private key to sign the item with.
+// - salt: The salt distinguishing several items signed with the same key; may be empty.
+// - seq: The sequence number of the item.
+// - v: The value of the item; it is bencoded with Marshal.
+//
+// Returns:
+// - The target the item is stored under.
+// - An error if the value or salt is too big or no node stored the item.
+func (d *DHT) PutMutable(key ed25519.PrivateKey, salt []byte, seq int64, v interface{}) (NodeID, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return NodeID{}, err
+	}
+	if len(data) > dhtMaxItemSize {
+		return NodeID{}, fmt.Errorf("item of %d bytes exceeds %d bytes", len(data), dhtMaxItemSize)
+	}
+	if len(salt) > dhtMaxSaltSize {
+		return NodeID{}, fmt.Errorf("salt of %d bytes exceeds %d bytes", len(salt), dhtMaxSaltSize)
+	}
+
+	pub := key.Public().(ed25519.PublicKey)
+	target := MutableTarget(pub, salt)
+	result, err := d.lookup(target, "get")
+	if err != nil {
+		return target, err
+	}
+
+	args := krpcArgs{V: data, K: pub, Salt: salt, Seq: &seq, Sig: ed25519.Sign(key, signedData(salt, seq, data))}
+	return target, d.sendWithTokens(result, "put", args)
+}
+
+// GetMutable reads a mutable item from the DHT. Of the correctly signed
+// items returned, the one with the highest sequence number wins.
+//
+// Parameters:
+// - key: The ed25519 public key the item is signed with.
+// - salt: The salt the item was put with; may be empty.
+//
+// Returns:
+// - A pointer to the item.
+// - An error if no node returned a correctly signed item.
+func (d *DHT) GetMutable(key ed25519.PublicKey, salt []byte) (*MutableItem, error) {
+	target := MutableTarget(key, salt)
+	result, err := d.lookup(target, "get")
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *MutableItem
+	for _, r := range result.items {
+		if r.V == nil || r.Seq == nil || !bytes.Equal(r.K, key) {
+			continue
+		}
+		if len(r.Sig) != ed25519.SignatureSize || !ed25519.Verify(key, signedData(salt, *r.Seq, r.V), r.Sig) {
+			continue
+		}
+
+		if latest == nil || *r.Seq > latest.Seq {
+			latest = &MutableItem{Key: key, Salt: salt, Seq: *r.Seq, V: r.V, Sig: r.Sig}
+		}
+	}
+
+	if latest == nil {
+		return nil, fmt.Errorf("item %s not found", target)
+	}
+	return latest, nil
+}
@@ -0,0 +1,265 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dhtK               = 8 // nodes per bucket and per lookup result
+	dhtBucketCount     = 160
+	dhtMaxFailures     = 2 // failed queries after which a node is no longer good
+	dhtQuestionableAge = 15 * time.Minute
+	compactNodeSize    = 20 + compactV4Size
+	compactNode6Size   = 20 + compactV6Size
+)
+
+// NodeID identifies a DHT node, and is drawn from the same 160-bit space as
+// info hashes.
+type NodeID [20]byte
+
+// RandomNodeID returns a random node ID.
+func RandomNodeID() (NodeID, error) {
+	var id NodeID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// ParseNodeID parses a node ID or info hash given as 40 hex digits.
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid node id %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// distance returns the XOR distance between two IDs.
+func (id NodeID) distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to id than b.
+func (id NodeID) closer(a, b NodeID) bool {
+	da, db := id.distance(a), id.distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits id and other share.
+func (id NodeID) commonPrefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// Node is a DHT node.
+type Node struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// encodeCompactNodes encodes nodes in compact node info form: the 20-byte ID
+// of each node followed by its compact address. IPv4 and IPv6 nodes are
+// returned in separate lists.
+func encodeCompactNodes(nodes []Node) ([]byte, []byte) {
+	var v4, v6 []byte
+	for _, node := range nodes {
+		if ip4 := node.Addr.IP.To4(); ip4 != nil {
+			v4 = append(v4, node.ID[:]...)
+			v4 = binary.BigEndian.AppendUint16(append(v4, ip4...), uint16(node.Addr.Port))
+		} else {
+			v6 = append(v6, node.ID[:]...)
+			v6 = binary.BigEndian.AppendUint16(append(v6, node.Addr.IP.To16()...), uint16(node.Addr.Port))
+		}
+	}
+	return v4, v6
+}
+
+// decodeCompactNodes decodes a list of nodes in compact node info form, with
+// addresses of ipSize bytes.
+func decodeCompactNodes(data []byte, ipSize int) ([]Node, error) {
+	size := 20 + ipSize + 2
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("compact node list of %d bytes is not a multiple of %d", len(data), size)
+	}
+
+	var nodes []Node
+	for i := 0; i < len(data); i += size {
+		var node Node
+		copy(node.ID[:], data[i:i+20])
+		ip := make(net.IP, ipSize)
+		copy(ip, data[i+20:i+20+ipSize])
+		node.Addr = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[i+20+ipSize : i+size]))}
+		if node.Addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// tableNode is a node in the routing table.
+type tableNode struct {
+	Node
+	lastSeen time.Time // zero for nodes loaded from a saved table and not heard from since
+	failures int       // consecutive queries the node did not answer
+}
+
+// good reports whether the node is known to answer queries.
+func (n *tableNode) good() bool {
+	return n.failures < dhtMaxFailures
+}
+
+// questionable reports whether the node may be replaced by a new one.
+func (n *tableNode) questionable() bool {
+	return !n.good() || time.Since(n.lastSeen) > dhtQuestionableAge
+}
+
+// routingTable is the routing table of BEP 5: nodes are kept in k-buckets
+// by the length of the prefix their ID shares with ours, so that the table
+// knows many nodes close to us and a few far away. It is safe for concurrent use.
+type routingTable struct {
+	self    NodeID
+	mu      sync.Mutex
+	buckets [dhtBucketCount][]*tableNode
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// bucket returns the index of the bucket the node with the given ID belongs to.
+func (rt *routingTable) bucket(id NodeID) int {
+	return min(rt.self.commonPrefixLen(id), dhtBucketCount-1)
+}
+
+// insert adds a node to the table or refreshes it. seen reports whether the
+// node has just been heard from. A full bucket takes a new node only in place
+// of a questionable one.
+func (rt *routingTable) insert(node Node, seen bool) {
+	if node.ID == rt.self || node.Addr == nil {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucket(node.ID)
+	bucket := rt.buckets[b]
+	for i, n := range bucket {
+		if n.ID != node.ID {
+			continue
+		}
+
+		if seen {
+			n.Addr = node.Addr
+			n.lastSeen = time.Now()
+			n.failures = 0
+			// Most recently seen nodes go to the back.
+			rt.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+		}
+		return
+	}
+
+	entry := &tableNode{Node: node}
+	if seen {
+		entry.lastSeen = time.Now()
+	}
+
+	if len(bucket) < dhtK {
+		rt.buckets[b] = append(bucket, entry)
+		return
+	}
+
+	for i, n := range bucket {
+		if n.questionable() {
+			rt.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), entry)
+			return
+		}
+	}
+}
+
+// failed records that the node at addr did not answer a query.
+func (rt *routingTable) failed(addr *net.UDPAddr) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if n.Addr.IP.Equal(addr.IP) && n.Addr.Port == addr.Port {
+				n.failures++
+			}
+		}
+	}
+}
+
+// closest returns up to count good nodes closest to target.
+func (rt *routingTable) closest(target NodeID, count int) []Node {
+	rt.mu.Lock()
+	var nodes []Node
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if n.good() {
+				nodes = append(nodes, n.Node)
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	return nodes[:min(len(nodes), count)]
+}
+
+// nodes returns every node in the table.
+func (rt *routingTable) nodes() []Node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var nodes []Node
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			nodes = append(nodes, n.Node)
+		}
+	}
+	return nodes
+}
+
+// len returns the number of nodes in the table.
+func (rt *routingTable) len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	count := 0
+	for _, bucket := range rt.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// sortByDistance sorts nodes by their distance to target, closest first.
+func sortByDistance(nodes []Node, target NodeID) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.closer(nodes[i].ID, nodes[j].ID)
+	})
+}
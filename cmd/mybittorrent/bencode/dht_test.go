@@ -0,0 +1,211 @@
+package bencode
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestSwarm starts n DHT nodes on the loopback interface, each
+// bootstrapped off the first, and closes them when the test ends.
+func newTestSwarm(t *testing.T, n int) []*DHT {
+	t.Helper()
+
+	nodes := make([]*DHT, 0, n)
+	t.Cleanup(func() {
+		for _, d := range nodes {
+			d.Close()
+		}
+	})
+
+	for i := 0; i < n; i++ {
+		cfg := DHTConfig{Addr: "127.0.0.1:0", BootstrapNodes: []string{}, Timeout: 500 * time.Millisecond, InsecureIDs: true}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+
+		d, err := NewDHT(cfg)
+		if err != nil {
+			t.Fatalf("NewDHT: %v", err)
+		}
+		nodes = append(nodes, d)
+
+		if i > 0 {
+			if err := d.Bootstrap(); err != nil {
+				t.Fatalf("Bootstrap of node %d: %v", i, err)
+			}
+		}
+	}
+	return nodes
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestSwarm(t, 6)
+
+	infoHash, err := RandomNodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nodes[1].AnnouncePeer(infoHash, 5555); err != nil {
+		t.Fatalf("AnnouncePeer: %v", err)
+	}
+
+	for i, d := range nodes[2:] {
+		peers, err := d.GetPeers(infoHash)
+		if err != nil {
+			t.Fatalf("GetPeers from node %d: %v", i+2, err)
+		}
+		if len(peers) != 1 || peers[0] != "127.0.0.1:5555" {
+			t.Fatalf("GetPeers from node %d = %v, want [127.0.0.1:5555]", i+2, peers)
+		}
+	}
+}
+
+func TestDHTDropsResponsesFromOtherNodes(t *testing.T) {
+	nodes := newTestSwarm(t, 2)
+
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	// Answer every query sent to the spoofer from a different socket.
+	go func() {
+		buf := make([]byte, dhtMaxPacketSize)
+		for {
+			n, addr, err := spoofer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var msg krpcMessage
+			if Unmarshal(buf[:n], &msg) != nil {
+				continue
+			}
+			id := nodes[1].ID()
+			reply, _ := Marshal(krpcMessage{T: msg.T, Y: "r", R: &krpcReturn{ID: id[:]}})
+			nodes[1].conn.WriteTo(reply, addr)
+		}
+	}()
+
+	if _, err := nodes[0].Ping(spoofer.LocalAddr().String()); err == nil {
+		t.Fatal("Ping accepted a response from another node")
+	}
+	if _, err := nodes[0].Ping(nodes[1].Addr().String()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestDHTCapsStoredPeers(t *testing.T) {
+	nodes := newTestSwarm(t, 1)
+	d := nodes[0]
+
+	stored := func(infoHash NodeID) (int, int) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.peers[infoHash]), d.peerCount
+	}
+
+	var infoHash NodeID
+	for port := 1; port <= dhtMaxPeersPerHash+10; port++ {
+		d.storePeer(infoHash, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port})
+	}
+	if got, _ := stored(infoHash); got != dhtMaxPeersPerHash {
+		t.Fatalf("stored %d peers for one info hash, want %d", got, dhtMaxPeersPerHash)
+	}
+
+	for i := 1; i <= dhtMaxStoredPeers/dhtMaxPeersPerHash; i++ {
+		other := NodeID{byte(i >> 8), byte(i)}
+		for port := 1; port <= dhtMaxPeersPerHash; port++ {
+			d.storePeer(other, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: port})
+		}
+	}
+	if _, total := stored(infoHash); total != dhtMaxStoredPeers {
+		t.Fatalf("stored %d peers in total, want %d", total, dhtMaxStoredPeers)
+	}
+
+	full := NodeID{0xff}
+	d.storePeer(full, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1})
+	if got, _ := stored(full); got != 0 {
+		t.Fatalf("stored %d peers past the total cap, want 0", got)
+	}
+}
+
+func TestDHTPutAndGetImmutable(t *testing.T) {
+	nodes := newTestSwarm(t, 6)
+
+	target, err := nodes[1].PutImmutable("Hello World!")
+	if err != nil {
+		t.Fatalf("PutImmutable: %v", err)
+	}
+	// Test vector of BEP 44.
+	if want := "e5f96f6f38320f0f33959cb4d3d656452117aadb"; target.String() != want {
+		t.Fatalf("PutImmutable target = %s, want %s", target, want)
+	}
+
+	v, err := nodes[5].GetImmutable(target)
+	if err != nil {
+		t.Fatalf("GetImmutable: %v", err)
+	}
+	if string(v) != "12:Hello World!" {
+		t.Fatalf("GetImmutable = %q, want %q", v, "12:Hello World!")
+	}
+}
+
+func TestDHTPutAndGetMutable(t *testing.T) {
+	nodes := newTestSwarm(t, 6)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("release")
+
+	if _, err := nodes[1].PutMutable(priv, salt, 1, "first"); err != nil {
+		t.Fatalf("PutMutable seq 1: %v", err)
+	}
+	if _, err := nodes[2].PutMutable(priv, salt, 2, "second"); err != nil {
+		t.Fatalf("PutMutable seq 2: %v", err)
+	}
+
+	// Every node the stale put reaches holds seq 2, since a node puts to the
+	// same closest nodes each time.
+	_, err = nodes[2].PutMutable(priv, salt, 1, "stale")
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != KRPCSeqTooLow {
+		t.Fatalf("PutMutable with a lower seq: got %v, want KRPC error %d", err, KRPCSeqTooLow)
+	}
+
+	item, err := nodes[5].GetMutable(pub, salt)
+	if err != nil {
+		t.Fatalf("GetMutable: %v", err)
+	}
+	if item.Seq != 2 || string(item.V) != "6:second" {
+		t.Fatalf("GetMutable = seq %d, v %q; want seq 2, v %q", item.Seq, item.V, "6:second")
+	}
+}
+
+func TestDHTCapsStoredItems(t *testing.T) {
+	nodes := newTestSwarm(t, 1)
+	d := nodes[0]
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := 0; i < dhtMaxItems; i++ {
+		if err := d.putItem(NodeID{byte(i >> 8), byte(i)}, &dhtItem{storedAt: time.Now()}); err != nil {
+			t.Fatalf("putItem %d: %v", i, err)
+		}
+	}
+
+	if err := d.putItem(NodeID{0xff}, &dhtItem{storedAt: time.Now()}); err == nil || err.Code != KRPCServerError {
+		t.Fatalf("putItem past the cap: got %v, want KRPC error %d", err, KRPCServerError)
+	}
+	if err := d.putItem(NodeID{0, 1}, &dhtItem{storedAt: time.Now()}); err != nil {
+		t.Fatalf("putItem replacing a stored item: %v", err)
+	}
+}
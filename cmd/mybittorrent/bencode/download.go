@@ -2,15 +2,21 @@ package bencode
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
+	MsgChoke      = 0
 	MsgUnChoke    = 1
 	MsgInterested = 2
 	MsgBitfield   = 5
@@ -20,82 +26,425 @@ const (
 
 const (
 	BlockSize = 16 * 1024 // 16KB
+
+	minReannounceWait      = time.Minute      // shortest wait between regular announces while downloading
+	stoppedAnnounceTimeout = 10 * time.Second // longest we wait for trackers to hear we stopped
+	maxDownloadPeers       = 5                // peers downloaded from at once
+	emptyPoolWait          = time.Second      // wait before looking at an empty pool again while other peers download
 )
 
-// DownLoadFile downloads the specified pieces of a torrent file and writes them to an output file.
+// DownLoadFile downloads the specified pieces of a torrent and writes them to disk.
+// For a single-file torrent the pieces are written back to back to outputFile.
+// For a multi-file torrent outputFile is the directory taking the place of the
+// torrent's name, and each piece is written at its place in the torrent's data,
+// split across the files it spans.
+//
+// The trackers are told when the download starts, completes and stops, and
+// are announced to again whenever they ask to be while the download runs.
+// Peers reported by the trackers go into a PeerPool, along with every peer
+// learned through peer exchange (BEP 11) while downloading; private torrents
+// (BEP 27) take no part in peer exchange. Pieces are downloaded from up to
+// maxDownloadPeers peers of the pool at once; when a peer fails, the piece it
+// was downloading goes to another peer, and the next peer in the pool takes
+// its place. Meanwhile, peers of the torrent may connect to the session's
+// listener (see Session.Listener).
 //
 // Parameters:
 // - t: A TorrentInfo struct containing information about the torrent.
-// - outputFile: A string representing the path to the output file where the downloaded data will be written.
+// - outputFile: A string representing the path to the output file (or directory) where the downloaded data will be written.
 // - pieceIndices: A variadic integer slice representing the indices of the pieces to be downloaded.
 //
 // Returns:
 // - An error if any step in the process fails.
 func DownLoadFile(t TorrentInfo, outputFile string, pieceIndices ...int) error {
-	trackerResp, err := CallTracker(t)
+	pool := NewPeerPool()
+	listener, err := CurrentSession().Listener()
 	if err != nil {
+		return fmt.Errorf("error listening for peers: %w", err)
+	}
+	if err := listener.Add(t, pool); err != nil {
 		return err
 	}
+	defer listener.Remove(t)
 
-	peers, err := ExtractPeers(trackerResp)
+	trackers := NewTrackerManager(t)
+	peers, err := trackers.Announce(EventStarted)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+		defer cancel()
+		trackers.AnnounceContext(ctx, EventStopped)
+	}()
+
+	pool.Add(peers...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reannounce(ctx, trackers, pool)
+
+	var mu sync.Mutex
+	pieces := make(map[int][]byte, len(pieceIndices))
+	store := func(pieceIdx int, piece []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pieces[pieceIdx] = piece
+		return nil
+	}
+
+	if t.IsMultiFile() {
+		layout := newFileLayout(t, outputFile)
+		if err := layout.create(); err != nil {
+			return fmt.Errorf("error creating files: %w", err)
+		}
+
+		store = func(pieceIdx int, piece []byte) error {
+			return layout.writeAt(piece, int64(pieceIdx)*t.PieceLength)
+		}
+	}
 
-	var conn net.Conn
-	for _, peer := range peers {
-		conn, _, err = HandShakeWithPeer(t, peer)
+	// Stored pieces count as downloaded in the next announce.
+	storeAndCount := func(pieceIdx int, piece []byte) error {
+		if err := store(pieceIdx, piece); err != nil {
+			return err
+		}
+		trackers.Stats.Downloaded(int64(len(piece)))
+		return nil
+	}
+
+	d := &download{t: t, pool: pool, queue: newPieceQueue(pieceIndices), store: storeAndCount}
+	if err := d.run(); err != nil {
+		return err
+	}
+
+	if !t.IsMultiFile() {
+		var fileData []byte
+		for _, pieceIdx := range pieceIndices {
+			fileData = append(fileData, pieces[pieceIdx]...)
+		}
+		if err := os.WriteFile(outputFile, fileData, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	if len(pieceIndices) == t.PieceCount() {
+		trackers.Announce(EventCompleted)
+	}
+	return nil
+}
+
+// reannounce sends regular announces to the trackers when NextAnnounce says
+// they are due, adding the peers reported to the pool, until ctx is done.
+func reannounce(ctx context.Context, trackers *TrackerManager, pool *PeerPool) {
+	for {
+		wait := defaultAnnounceInterval
+		if next := trackers.NextAnnounce(); !next.IsZero() {
+			wait = max(time.Until(next), minReannounceWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		peers, err := trackers.AnnounceContext(ctx, EventNone)
 		if err == nil {
-			break
+			pool.Add(peers...)
 		}
 	}
+}
+
+// download is a download of pieces of a torrent from several peers at once.
+type download struct {
+	t     TorrentInfo
+	pool  *PeerPool
+	queue *pieceQueue
+	store func(int, []byte) error
+
+	peers atomic.Int32 // peers being connected to or downloaded from
+
+	mu        sync.Mutex
+	connected bool  // whether any peer was connected to
+	peerErr   error // last failure of a single peer
+	err       error // error that stopped the download
+}
+
+// run downloads every piece of the queue, from up to maxDownloadPeers peers
+// at once, and returns once no piece is left or no peer is left to try.
+func (d *download) run() error {
+	var wg sync.WaitGroup
+	for i := 0; i < maxDownloadPeers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work()
+		}()
+	}
+	wg.Wait()
 
-	if conn == nil {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case d.err != nil:
+		return d.err
+	case d.queue.remaining() == 0:
+		return nil
+	case !d.connected:
 		return fmt.Errorf("failed to connect to any peers")
+	default:
+		return fmt.Errorf("error downloading piece: %w", d.peerErr)
 	}
+}
 
-	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
-			fmt.Println("error closing connection")
+// work downloads pieces from one peer of the pool after another. It returns
+// once no piece is left, or once the pool is empty and no other peer is
+// being downloaded from that could tell us about new ones.
+func (d *download) work() {
+	for {
+		select {
+		case <-d.queue.done:
+			return
+		default:
 		}
-	}(conn)
 
-	if err := establishConnectionToDownloadPiece(conn); err != nil {
-		return fmt.Errorf("error establishing connection: %w", err)
+		addr, ok := d.pool.Next()
+		if !ok {
+			if d.peers.Load() == 0 {
+				return
+			}
+
+			select {
+			case <-d.queue.done:
+				return
+			case <-time.After(emptyPoolWait):
+			}
+			continue
+		}
+
+		d.peers.Add(1)
+		err := d.downloadFrom(addr)
+		d.peers.Add(-1)
+
+		d.mu.Lock()
+		if isPeerError(err) {
+			d.peerErr = err
+		} else if err != nil && d.err == nil {
+			d.err = err
+			d.queue.stop()
+		}
+		d.mu.Unlock()
+	}
+}
+
+// downloadFrom connects to the peer at addr and downloads pieces of the queue
+// from it until none is left or the peer fails.
+func (d *download) downloadFrom(addr string) error {
+	peer, err := connectForDownload(d.t, addr, d.pool)
+	if err != nil {
+		return &peerError{fmt.Errorf("peer %s: %w", addr, err)}
+	}
+
+	d.mu.Lock()
+	d.connected = true
+	d.mu.Unlock()
+
+	err = downloadFromPeer(peer, d.t, d.queue, d.store)
+	if closeErr := peer.Close(); closeErr != nil {
+		fmt.Println("error closing connection")
+	}
+	d.pool.Dropped(addr)
+	return err
+}
+
+// pieceQueue hands out the pieces of a download to the peers downloading
+// them. A piece a peer fails to deliver goes back into the queue for another
+// peer to download. It is safe for concurrent use.
+type pieceQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []int
+	active  int           // pieces handed out, neither stored nor given back yet
+	stopped bool          // the download failed; no more pieces are handed out
+	done    chan struct{} // closed once every piece is stored or the download stopped
+	closed  bool          // whether done is closed
+}
+
+// newPieceQueue creates a queue of the given pieces, handed out in order.
+func newPieceQueue(pieces []int) *pieceQueue {
+	q := &pieceQueue{pending: append([]int(nil), pieces...), done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	q.update()
+	return q
+}
+
+// next hands out the next piece to download. While every remaining piece is
+// handed out, it waits for one to be given back. It returns false once every
+// piece is stored or the download stopped.
+func (q *pieceQueue) next() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.pending) == 0 && q.active > 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.stopped || len(q.pending) == 0 {
+		return 0, false
 	}
 
-	var fileData []byte
-	for _, pieceIdx := range pieceIndices {
-		piece, err := downloadPiece(conn, t, pieceIdx)
+	pieceIdx := q.pending[0]
+	q.pending = q.pending[1:]
+	q.active++
+	return pieceIdx, true
+}
+
+// stored records that a piece handed out has been stored.
+func (q *pieceQueue) stored() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.active--
+	q.update()
+}
+
+// giveBack puts a piece handed out back into the queue.
+func (q *pieceQueue) giveBack(pieceIdx int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.active--
+	q.pending = append(q.pending, pieceIdx)
+	q.update()
+}
+
+// stop stops handing out pieces.
+func (q *pieceQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stopped = true
+	q.update()
+}
+
+// remaining returns the number of pieces not stored yet.
+func (q *pieceQueue) remaining() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending) + q.active
+}
+
+// update wakes the peers waiting for a piece, and closes q.done once no piece
+// is left or the download stopped. q.mu must be held.
+func (q *pieceQueue) update() {
+	q.cond.Broadcast()
+	if !q.closed && (q.stopped || len(q.pending)+q.active == 0) {
+		close(q.done)
+		q.closed = true
+	}
+}
+
+// connectForDownload connects to a peer of the pool, tells it about the
+// other peers we are connected to, and waits until it unchokes us.
+func connectForDownload(t TorrentInfo, addr string, pool *PeerPool) (*PeerConn, error) {
+	peer, err := ExtendedHandShakeWithPeer(t, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.Pool = pool
+	pool.Connected(addr)
+
+	if err := peer.sendPexUpdate(); err != nil {
+		peer.Close()
+		pool.Dropped(addr)
+		return nil, err
+	}
+
+	if err := establishConnectionToDownloadPiece(peer); err != nil {
+		peer.Close()
+		pool.Dropped(addr)
+		return nil, fmt.Errorf("error establishing connection: %w", err)
+	}
+	return peer, nil
+}
+
+// peerError is a failure of a single peer, after which the download can
+// carry on from another one.
+type peerError struct {
+	err error
+}
+
+func (e *peerError) Error() string { return e.err.Error() }
+
+func (e *peerError) Unwrap() error { return e.err }
+
+// isPeerError reports whether err is a failure of a single peer.
+func isPeerError(err error) bool {
+	var pe *peerError
+	return errors.As(err, &pe)
+}
+
+// downloadFromPeer downloads pieces of the queue from a peer, handing each
+// one to store as soon as it has been verified. Between pieces the peer is
+// kept up to date with the peers we connect to and drop (BEP 11).
+//
+// Parameters:
+// - peer: A pointer to a PeerConn that has unchoked us.
+// - t: A TorrentInfo struct containing information about the torrent.
+// - queue: The queue handing out the pieces to be downloaded; a piece the peer fails to deliver is given back.
+// - store: The function each verified piece is passed to.
+//
+// Returns:
+// - A *peerError if the peer failed, or the error returned by store.
+func downloadFromPeer(peer *PeerConn, t TorrentInfo, queue *pieceQueue, store func(int, []byte) error) error {
+	for {
+		pieceIdx, ok := queue.next()
+		if !ok {
+			return nil
+		}
+
+		piece, err := downloadPiece(peer, t, pieceIdx)
 		if err != nil {
-			return fmt.Errorf("error downloading piece: %w", err)
+			queue.giveBack(pieceIdx)
+			return &peerError{fmt.Errorf("peer %s: %w", peer.Addr, err)}
 		}
 
-		fileData = append(fileData, piece...)
-	}
+		if err := store(pieceIdx, piece); err != nil {
+			queue.giveBack(pieceIdx)
+			return err
+		}
+		queue.stored()
 
-	return os.WriteFile(outputFile, fileData, os.ModePerm)
+		if err := peer.sendPexUpdate(); err != nil {
+			return &peerError{fmt.Errorf("peer %s: %w", peer.Addr, err)}
+		}
+	}
 }
 
 // establishConnectionToDownloadPiece establishes a connection to download a piece from a peer.
 //
 // Parameters:
-// - conn: A net.Conn representing the TCP connection to the peer.
+// - peer: A pointer to a PeerConn after the handshake.
 //
 // Returns:
 // - An error if any step in the process fails.
-func establishConnectionToDownloadPiece(conn net.Conn) error {
-	reader := bufio.NewReader(conn)
-	if err := waitForBitField(reader); err != nil {
-		return err
+func establishConnectionToDownloadPiece(peer *PeerConn) error {
+	if peer.Bitfield == nil {
+		if err := waitForBitField(peer); err != nil {
+			return err
+		}
 	}
 
-	if err := sendInterested(conn); err != nil {
+	if err := sendInterested(peer); err != nil {
 		return err
 	}
 
-	if err := waitForUnChoke(reader); err != nil {
+	if err := waitForUnChoke(peer); err != nil {
 		return err
 	}
 
@@ -105,20 +454,19 @@ func establishConnectionToDownloadPiece(conn net.Conn) error {
 // downloadPiece downloads a specific piece from a peer and verifies its hash.
 //
 // Parameters:
-// - conn: A net.Conn representing the TCP connection to the peer.
+// - peer: A pointer to a PeerConn that has unchoked us.
 // - t: A TorrentInfo struct containing information about the torrent.
 // - pieceIndex: An integer representing the index of the piece to be downloaded.
 //
 // Returns:
 // - A byte slice containing the downloaded piece data.
 // - An error if any step in the process fails.
-func downloadPiece(conn net.Conn, t TorrentInfo, pieceIndex int) ([]byte, error) {
-	pieceSize := t.PieceLength
-	pieceCnt := int(math.Ceil(float64(t.Length) / float64(pieceSize)))
-	if pieceIndex == pieceCnt-1 {
-		pieceSize = t.Length % t.PieceLength
+func downloadPiece(peer *PeerConn, t TorrentInfo, pieceIndex int) ([]byte, error) {
+	if pieceIndex < 0 || pieceIndex >= t.PieceCount() {
+		return nil, fmt.Errorf("piece index %d out of range", pieceIndex)
 	}
 
+	pieceSize := t.PieceSize(pieceIndex)
 	blockCnt := int(math.Ceil(float64(pieceSize) / float64(BlockSize)))
 
 	var piece []byte
@@ -130,12 +478,12 @@ func downloadPiece(conn net.Conn, t TorrentInfo, pieceIndex int) ([]byte, error)
 
 		index := i * BlockSize
 		// Send request for block
-		if err := sendRequest(conn, pieceIndex, index, blockLength); err != nil {
+		if err := sendRequest(peer, pieceIndex, index, blockLength); err != nil {
 			return nil, fmt.Errorf("error sending request: %w", err)
 		}
 
 		// Receive block
-		block, err := receivePiece(conn, pieceIndex, index)
+		block, err := receivePiece(peer, pieceIndex, index)
 		if err != nil {
 			return nil, fmt.Errorf("error receiving block: %w", err)
 		}
@@ -143,30 +491,29 @@ func downloadPiece(conn net.Conn, t TorrentInfo, pieceIndex int) ([]byte, error)
 		piece = append(piece, block...)
 	}
 
-	if !verifyPiece(piece, []byte(t.PieceHashes[pieceIndex])) {
+	if !t.verifyPiece(pieceIndex, piece) {
 		return nil, fmt.Errorf("piece hash does not match")
 	}
 	return piece, nil
 }
 
-// waitForBitField waits for a bitfield message from the peer.
+// waitForBitField waits for a bitfield message from the peer, skipping any
+// other message, such as the peer's extension handshake.
 //
 // Parameters:
-// - reader: A pointer to a bufio.Reader from which the bitfield message will be read.
+// - peer: A pointer to a PeerConn from which the bitfield message will be read.
 //
 // Returns:
 // - An error if any step in the process fails.
-func waitForBitField(reader *bufio.Reader) error {
+func waitForBitField(peer *PeerConn) error {
 	for {
-		msgLen, msgId, err := readMessageHeader(reader)
+		msgId, payload, err := peer.receive()
 		if err != nil {
 			return err
 		}
 
 		if msgId == MsgBitfield { // Bitfield message
-			if _, err := reader.Discard(msgLen - 1); err != nil {
-				return err
-			}
+			peer.Bitfield = payload
 			break
 		}
 	}
@@ -195,13 +542,13 @@ func sendInterested(conn net.Conn) error {
 // waitForUnChoke waits for an "unchoke" message from the peer.
 //
 // Parameters:
-// - reader: A pointer to a bufio.Reader from which the "unchoke" message will be read.
+// - peer: A pointer to a PeerConn from which the "unchoke" message will be read.
 //
 // Returns:
 // - An error if any step in the process fails or if the connection is closed unexpectedly.
-func waitForUnChoke(reader *bufio.Reader) error {
+func waitForUnChoke(peer *PeerConn) error {
 	for {
-		_, msgId, err := readMessageHeader(reader)
+		msgId, _, err := peer.receive()
 		if err != nil {
 			return err
 		}
@@ -236,29 +583,36 @@ func sendRequest(conn net.Conn, index, begin, length int) error {
 }
 
 // receivePiece reads a piece message from the peer and verifies its index and begin offset.
+// Messages other than piece and choke messages, such as have messages, are skipped.
 //
 // Parameters:
-// - conn: A net.Conn representing the TCP connection to the peer.
+// - peer: A pointer to a PeerConn from which the piece message will be read.
 // - expectedIndex: An integer representing the expected piece index.
 // - expectedBegin: An integer representing the expected beginning offset within the piece.
 //
 // Returns:
 // - A byte slice containing the piece data.
 // - An error if any step in the process fails or if the received piece does not match the expected index and begin offset
-func receivePiece(conn net.Conn, expectedIndex, expectedBegin int) ([]byte, error) {
-	reader := bufio.NewReader(conn)
-	msgLen, msgId, err := readMessageHeader(reader)
-	if err != nil {
-		return nil, err
-	}
+func receivePiece(peer *PeerConn, expectedIndex, expectedBegin int) ([]byte, error) {
+	var payload []byte
+	for {
+		msgId, data, err := peer.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		if msgId == MsgChoke {
+			return nil, fmt.Errorf("peer choked us")
+		}
 
-	if msgId != MsgPiece {
-		return nil, fmt.Errorf("expected piece message but got %d", msgId)
+		if msgId == MsgPiece {
+			payload = data
+			break
+		}
 	}
 
-	payload := make([]byte, msgLen-1)
-	if _, err := io.ReadFull(reader, payload); err != nil {
-		return nil, err
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("piece message of %d bytes is too short", len(payload))
 	}
 
 	index := int(binary.BigEndian.Uint32(payload[:4]))
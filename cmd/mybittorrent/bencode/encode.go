@@ -1,108 +1,237 @@
 package bencode
 
 import (
-	"fmt"
+	"bufio"
+	"io"
+	"math/big"
+	"reflect"
 	"sort"
-	"strings"
+	"strconv"
 )
 
+// Encoder writes bencoded values to an output stream.
+// Values are written as they are walked, so encoding a large value does not
+// build its whole encoding in memory first.
 type Encoder struct {
+	out io.Writer
+	w   *bufio.Writer
 }
 
-func (e *Encoder) Encode(value interface{}) (string, error) {
-	return e.encodeValue(value)
+// NewEncoder creates a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{out: w, w: bufio.NewWriter(w)}
 }
 
-// encodeValue encodes a given value into a bencoded string based on its type.
-// The function supports encoding integers, strings, lists, and dictionaries.
+// Encode writes the bencoding of value to the stream, following the rules of
+// Marshal. Nothing is left buffered in the encoder once Encode returns. If the
+// value cannot be encoded, the part of it still buffered is discarded, but
+// bytes of a large value may already have reached the underlying writer.
+func (e *Encoder) Encode(value interface{}) error {
+	if err := e.encodeValue(reflect.ValueOf(value)); err != nil {
+		e.w.Reset(e.out)
+		return err
+	}
+	return e.w.Flush()
+}
+
+// encodeValue encodes a given value based on its type.
+// The function supports encoding integers of every width, big.Int, bool (as 0
+// or 1), strings, byte slices and arrays, lists, maps with string keys and
+// structs, as well as values implementing Marshaler.
 //
 // Parameters:
-// - value: An interface{} representing the value to be encoded. The value can be of type int, string, []interface{}, or map[string]interface{}.
+// - value: A reflect.Value holding the value to be encoded.
 //
 // Returns:
-// - A string containing the bencoded representation of the value.
 // - An error if the value type is unsupported or if there is an error during encoding.
-func (e *Encoder) encodeValue(value interface{}) (string, error) {
-	switch valType := value.(type) {
-	case int:
-		return e.encodeInt(valType), nil
-	case string:
-		return e.encodeString(valType), nil
-	case []interface{}:
-		return e.encodeList(valType)
-	case map[string]interface{}:
-		return e.encodeDict(valType)
+func (e *Encoder) encodeValue(value reflect.Value) error {
+	if !value.IsValid() {
+		return &UnsupportedValueError{Value: value, Str: "nil"}
+	}
+
+	if value.Type().Implements(marshalerType) {
+		if value.Kind() == reflect.Pointer && value.IsNil() {
+			return &UnsupportedValueError{Value: value, Str: "nil pointer"}
+		}
+		return e.encodeMarshaler(value.Interface().(Marshaler), value.Type())
+	}
+
+	if value.CanAddr() && value.Addr().Type().Implements(marshalerType) {
+		return e.encodeMarshaler(value.Addr().Interface().(Marshaler), value.Type())
+	}
+
+	if value.Type() == bigIntType {
+		bigNum := value.Interface().(big.Int)
+		e.encodeNumber(bigNum.String())
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			e.encodeInt(1)
+		} else {
+			e.encodeInt(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeNumber(strconv.FormatUint(value.Uint(), 10))
+	case reflect.String:
+		e.encodeString(value.String())
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(value.Bytes())
+			return nil
+		}
+		return e.encodeList(value)
+	case reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			if !value.CanAddr() {
+				addressable := reflect.New(value.Type()).Elem()
+				addressable.Set(value)
+				value = addressable
+			}
+			e.encodeBytes(value.Slice(0, value.Len()).Bytes())
+			return nil
+		}
+		return e.encodeList(value)
+	case reflect.Map:
+		return e.encodeDict(value)
+	case reflect.Struct:
+		return e.encodeStruct(value)
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return &UnsupportedValueError{Value: value, Str: "nil " + value.Kind().String()}
+		}
+		return e.encodeValue(value.Elem())
 	default:
-		return "", fmt.Errorf("unsupported type: %T", value)
+		return &UnsupportedTypeError{Type: value.Type()}
+	}
+	return nil
+}
+
+// encodeMarshaler writes the output of m after checking that it is a single bencoded value.
+func (e *Encoder) encodeMarshaler(m Marshaler, t reflect.Type) error {
+	data, err := m.MarshalBencode()
+	if err != nil {
+		return &MarshalerError{Type: t, Err: err}
 	}
+
+	if err := checkValid(data); err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+
+	_, err = e.w.Write(data)
+	return err
+}
+
+// encodeInt encodes a signed integer value.
+func (e *Encoder) encodeInt(value int64) {
+	e.encodeNumber(strconv.FormatInt(value, 10))
 }
 
-// encodeInt encodes an integer value into a bencoded string.
-func (e *Encoder) encodeInt(value int) string {
-	return fmt.Sprintf("i%de", value)
+// encodeNumber encodes the decimal digits of an integer.
+func (e *Encoder) encodeNumber(digits string) {
+	e.w.WriteByte(TypeInt.Prefix())
+	e.w.WriteString(digits)
+	e.w.WriteByte(TypeInt.Suffix())
 }
 
-// encodeString encodes a string value into a bencoded string.
-func (e *Encoder) encodeString(s string) string {
-	return fmt.Sprintf("%d:%s", len(s), s)
+// encodeString encodes a string value as a bencoded byte string.
+func (e *Encoder) encodeString(s string) {
+	e.w.WriteString(strconv.Itoa(len(s)))
+	e.w.WriteByte(TypeString.Suffix())
+	e.w.WriteString(s)
 }
 
-// encodeList encodes a list of values into a bencoded string.
+// encodeBytes encodes a byte slice as a bencoded byte string.
+func (e *Encoder) encodeBytes(b []byte) {
+	e.w.WriteString(strconv.Itoa(len(b)))
+	e.w.WriteByte(TypeString.Suffix())
+	e.w.Write(b)
+}
+
+// encodeList encodes a slice or array.
 // The list is expected to be prefixed with 'l' and suffixed with 'e'.
 // For example, the list [123, "spam"] will be encoded to "li123e4:spame".
 //
 // Parameters:
-// - list: A slice of interface{} representing the list to be encoded.
+// - list: A reflect.Value holding the slice or array to be encoded.
 //
 // Returns:
-// - A string containing the bencoded representation of the list.
 // - An error if any of the values in the list cannot be encoded.
-func (e *Encoder) encodeList(list []interface{}) (string, error) {
-	var builder strings.Builder
-	builder.WriteByte(TypeList.Prefix())
-
-	for _, value := range list {
-		encoded, err := e.encodeValue(value)
-
-		if err != nil {
-			return "", err
+func (e *Encoder) encodeList(list reflect.Value) error {
+	e.w.WriteByte(TypeList.Prefix())
+	for i := 0; i < list.Len(); i++ {
+		if err := e.encodeValue(list.Index(i)); err != nil {
+			return err
 		}
-		builder.WriteString(encoded)
 	}
-	builder.WriteByte(TypeList.Suffix())
-	return builder.String(), nil
+	e.w.WriteByte(TypeList.Suffix())
+	return nil
 }
 
-// encodeDict encodes a dictionary into a bencoded string.
+// encodeDict encodes a map with string keys as a dictionary with sorted keys.
 // The dictionary is expected to be prefixed with 'd' and suffixed with 'e'.
 // For example, the dictionary {"foo": "bar"} will be encoded to "d3:foo3:bare".
+// Nil pointers, interfaces and maps have no bencode representation and are left out.
 //
 // Parameters:
-// - dict: A map[string]interface{} representing the dictionary to be encoded.
+// - dict: A reflect.Value holding the map to be encoded.
 //
 // Returns:
-// - A string containing the bencoded representation of the dictionary.
-// - An error if any of the values in the dictionary cannot be encoded.
-func (e *Encoder) encodeDict(dict map[string]interface{}) (string, error) {
-	var builder strings.Builder
-	builder.WriteByte(TypeDict.Prefix())
-	keys := make([]string, 0, len(dict))
-
-	for key := range dict {
-		keys = append(keys, key)
+// - An error if the map keys are not strings or any of the values cannot be encoded.
+func (e *Encoder) encodeDict(dict reflect.Value) error {
+	if dict.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: dict.Type()}
 	}
-	sort.Strings(keys)
 
+	keys := dict.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	e.w.WriteByte(TypeDict.Prefix())
 	for _, key := range keys {
-		builder.WriteString(e.encodeString(key))
-		encoded, err := e.encodeValue(dict[key])
+		elem := dict.MapIndex(key)
+		if isNilValue(elem) {
+			continue
+		}
 
-		if err != nil {
-			return "", err
+		e.encodeString(key.String())
+		if err := e.encodeValue(elem); err != nil {
+			return err
 		}
-		builder.WriteString(encoded)
 	}
+	e.w.WriteByte(TypeDict.Suffix())
+	return nil
+}
 
-	builder.WriteByte(TypeDict.Suffix())
-	return builder.String(), nil
+// encodeStruct encodes a struct as a dictionary keyed by its field names.
+func (e *Encoder) encodeStruct(value reflect.Value) error {
+	e.w.WriteByte(TypeDict.Prefix())
+	for _, f := range cachedFields(value.Type()) {
+		fv, ok := fieldByIndex(value, f.index, false)
+		if !ok || isNilValue(fv) || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+
+		e.encodeString(f.name)
+		if err := e.encodeValue(fv); err != nil {
+			return err
+		}
+	}
+	e.w.WriteByte(TypeDict.Suffix())
+	return nil
+}
+
+// isNilValue reports whether v holds a nil pointer, interface or map, which
+// have no bencode representation and are left out of dictionaries.
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map:
+		return v.IsNil()
+	}
+	return false
 }
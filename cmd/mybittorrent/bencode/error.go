@@ -1,18 +1,204 @@
 package bencode
 
-import "fmt"
-
-var StringOutOfBounds = fmt.Errorf("string out of bounds")
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
 
 var InvalidFormat = func(t Type) error {
 	format := t.String()
 	return fmt.Errorf("invalid format: %s", format)
 }
 
-var MissingPrefix = func(t Type) error {
-	return fmt.Errorf("missing prefix '%c' for type %s", t.Prefix(), t)
+// SyntaxError describes malformed bencode input: a byte that cannot appear
+// where it was found, or input that ends in the middle of a value.
+type SyntaxError struct {
+	Offset   int64  // offset of the offending byte in the input
+	Type     Type   // type of the value being decoded
+	Expected string // description of what the decoder expected
+	Found    byte   // the byte found instead; zero if EOF is set
+	EOF      bool   // the input ended before the value was complete
+}
+
+func (e *SyntaxError) Error() string {
+	if e.EOF {
+		return fmt.Sprintf("unexpected end of input in %s at offset %d: expected %s", e.Type, e.Offset, e.Expected)
+	}
+	return fmt.Sprintf("syntax error in %s at offset %d: expected %s, found %q", e.Type, e.Offset, e.Expected, e.Found)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF for truncated input, so that callers can
+// tell incomplete data from corrupt data.
+func (e *SyntaxError) Unwrap() error {
+	if e.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+var (
+	ErrLeadingZero  = errors.New("leading zero")
+	ErrNegativeZero = errors.New("negative zero")
+	ErrPlusSign     = errors.New("explicit plus sign")
+	ErrUnsortedKeys = errors.New("dictionary keys not sorted")
+	ErrDuplicateKey = errors.New("duplicate dictionary key")
+)
+
+// NonCanonicalError is returned by a strict Decoder when the input is valid
+// bencode but not in the single canonical form required by BEP 3.
+// Err is one of the ErrLeadingZero, ErrNegativeZero, ErrPlusSign,
+// ErrUnsortedKeys or ErrDuplicateKey sentinels.
+type NonCanonicalError struct {
+	Offset int64 // offset of the offending token in the input
+	Type   Type  // type of the value being decoded
+	Err    error
+}
+
+func (e *NonCanonicalError) Error() string {
+	return fmt.Sprintf("non-canonical %s at offset %d: %v", e.Type, e.Offset, e.Err)
+}
+
+func (e *NonCanonicalError) Unwrap() error {
+	return e.Err
+}
+
+var errEmptyRawMessage = errors.New("empty RawMessage")
+
+// ErrMissingPieceLayer is returned when a v2 torrent lacks the piece layer of
+// a file larger than one piece.
+var ErrMissingPieceLayer = errors.New("missing piece layer")
+
+// UnmarshalTypeError describes a bencoded value that cannot be stored in a Go value of a specific type.
+type UnmarshalTypeError struct {
+	Value  string       // description of the bencoded value
+	Type   reflect.Type // type of the Go value it could not be assigned to
+	Offset int64        // offset of the value in the input
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// InvalidUnmarshalError describes an invalid argument passed to Unmarshal or DecodeInto.
+// The argument must be a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "unmarshal into nil"
+	}
+
+	if e.Type.Kind() != reflect.Pointer {
+		return fmt.Sprintf("unmarshal into non-pointer %s", e.Type)
+	}
+	return fmt.Sprintf("unmarshal into nil %s", e.Type)
+}
+
+// UnsupportedTypeError is returned by Marshal when encoding a value of a type that has no bencode representation.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("unsupported type: %s", e.Type)
+}
+
+// UnsupportedValueError is returned by Marshal when encoding a value that has no bencode representation.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return fmt.Sprintf("unsupported value: %s", e.Str)
+}
+
+// MarshalerError wraps an error returned by a Marshaler, or invalid output it produced.
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return fmt.Sprintf("error calling MarshalBencode for type %s: %v", e.Type, e.Err)
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+// OverflowError describes a bencoded integer that does not fit in the Go type it is decoded into.
+type OverflowError struct {
+	Offset int64  // offset of the integer in the input
+	Value  string // the integer as written in the input
+	Kind   string // the Go type it was decoded into
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("integer %s overflows %s at offset %d", e.Value, e.Kind, e.Offset)
+}
+
+// DepthLimitError is returned when lists and dictionaries nest deeper than Limits.MaxDepth.
+type DepthLimitError struct {
+	Offset int64
+	Limit  int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("nesting depth exceeds limit of %d at offset %d", e.Limit, e.Offset)
+}
+
+// StringLimitError is returned when a byte string is longer than Limits.MaxStringLength.
+type StringLimitError struct {
+	Offset int64
+	Length int64
+	Limit  int64
+}
+
+func (e *StringLimitError) Error() string {
+	return fmt.Sprintf("string length %d exceeds limit of %d at offset %d", e.Length, e.Limit, e.Offset)
+}
+
+// ElementLimitError is returned when a list or dictionary holds more than Limits.MaxElements elements.
+type ElementLimitError struct {
+	Offset int64 // offset of the list or dictionary
+	Limit  int
+}
+
+func (e *ElementLimitError) Error() string {
+	return fmt.Sprintf("element count exceeds limit of %d in value at offset %d", e.Limit, e.Offset)
+}
+
+// InputLimitError is returned when decoding would consume more than Limits.MaxBytes bytes of input.
+type InputLimitError struct {
+	Offset int64
+	Limit  int64
+}
+
+func (e *InputLimitError) Error() string {
+	return fmt.Sprintf("input exceeds limit of %d bytes at offset %d", e.Limit, e.Offset)
+}
+
+// KRPCError is an error a DHT node answered a query with.
+type KRPCError struct {
+	Code    int64
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// TrackerFailure is the failure reason a tracker refused an announce or
+// scrape with.
+type TrackerFailure struct {
+	Reason string
 }
 
-var MissingSuffix = func(t Type) error {
-	return fmt.Errorf("missing suffix '%c'for type %s", t.Prefix(), t)
+func (e *TrackerFailure) Error() string {
+	return "tracker failure: " + e.Reason
 }
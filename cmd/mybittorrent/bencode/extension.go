@@ -0,0 +1,261 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	MsgExtended = 20 // extension protocol message (BEP 10)
+
+	extHandshakeID   = 0    // extended message id of the extension handshake
+	extensionBit     = 0x10 // bit of reserved[5] advertising the extension protocol
+	defaultReqq      = 250  // outstanding requests peers may queue with us
+	maxMessageLength = 4 * 1024 * 1024
+	peerDialTimeout  = 10 * time.Second // time to establish a TCP connection to a peer
+	peerReadTimeout  = time.Minute      // time a peer has to send its handshake or its next message
+)
+
+// localExtensions maps the extensions this client supports to the extended
+// message ids peers must use when sending them to us.
+var localExtensions = map[string]int64{}
+
+// ExtensionHandshake is the payload of the extension handshake (BEP 10).
+// Each side announces the extensions it supports in M, mapping extension names
+// to the extended message ids it wants to receive them under; an id of zero
+// disables an extension previously enabled.
+type ExtensionHandshake struct {
+	M            map[string]int64 `bencode:"m"`
+	V            string           `bencode:"v,omitempty"`             // client name and version
+	P            int64            `bencode:"p,omitempty"`             // TCP listen port
+	Reqq         int64            `bencode:"reqq,omitempty"`          // number of outstanding requests queued without dropping
+	MetadataSize int64            `bencode:"metadata_size,omitempty"` // size of the info dictionary (BEP 9)
+}
+
+// ExtensionID returns the extended message id the peer wants to receive the
+// named extension under, and whether the peer supports it at all.
+func (h ExtensionHandshake) ExtensionID(name string) (byte, bool) {
+	id, ok := h.M[name]
+	if !ok || id <= 0 || id > 255 {
+		return 0, false
+	}
+	return byte(id), true
+}
+
+// Extensions returns the names of the extensions the peer supports, sorted.
+func (h ExtensionHandshake) Extensions() []string {
+	names := make([]string, 0, len(h.M))
+	for name := range h.M {
+		if _, ok := h.ExtensionID(name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PeerConn is a connection to a peer after the BitTorrent handshake and, when
+// both sides support it, the extension handshake.
+type PeerConn struct {
+	net.Conn
+	Reader     *bufio.Reader
+	PeerID     []byte
+	Reserved   []byte
+	Extensions *ExtensionHandshake // nil if the peer does not support the extension protocol
+	Bitfield   []byte              // bitfield received while waiting for the extension handshake, if any
+	Addr       string              // address the peer was reached at
+	Pool       *PeerPool           // pool peers learned through peer exchange are added to; may be nil
+	Metadata   []byte              // info dictionary served to the peer over ut_metadata; nil rejects its requests
+	Private    bool                // the torrent is private (BEP 27), so no peers are exchanged
+
+	pexSent   map[string]bool // peers announced to the peer in ut_pex messages
+	pexSentAt time.Time       // when the last ut_pex message was sent
+	deadline  time.Time       // time the pending request must be answered by; zero if none
+}
+
+// SupportsExtensions reports whether the peer advertised the extension protocol in its handshake.
+func (p *PeerConn) SupportsExtensions() bool {
+	return p.Reserved[5]&extensionBit != 0
+}
+
+// ExtendedHandShakeWithPeer performs the BitTorrent handshake with a peer and,
+// if the peer advertises the extension protocol, exchanges extension handshakes
+// with it. A bitfield arriving before the peer's extension handshake is kept in
+// the returned PeerConn.
+//
+// Parameters:
+// - t: A TorrentInfo struct containing the torrent metadata.
+// - peerAddress: A string containing the address of the peer in the format "IP:port".
+//
+// Returns:
+// - A pointer to a PeerConn holding the connection and the negotiated extensions.
+// - An error if any step in the process fails.
+func ExtendedHandShakeWithPeer(t TorrentInfo, peerAddress string) (*PeerConn, error) {
+	conn, response, err := HandShakeWithPeer(t, peerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &PeerConn{
+		Conn:     conn,
+		Reader:   bufio.NewReader(conn),
+		PeerID:   response[48:68],
+		Reserved: response[20:28],
+		Addr:     peerAddress,
+		Metadata: t.RawInfo,
+		Private:  t.Private,
+	}
+
+	if !peer.SupportsExtensions() {
+		return peer, nil
+	}
+
+	if err := sendExtensionHandshake(conn, localExtensionHandshake(t)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending extension handshake: %w", err)
+	}
+
+	if err := peer.readExtensionHandshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading extension handshake: %w", err)
+	}
+
+	return peer, nil
+}
+
+// localExtensionHandshake returns the extension handshake sent to the peers
+// of a torrent, with the port peers can connect to us on, if we listen.
+func localExtensionHandshake(t TorrentInfo) ExtensionHandshake {
+	local := ExtensionHandshake{M: extensionsFor(t), V: defaultCreatedByID, Reqq: defaultReqq}
+	if t.RawInfo != nil {
+		local.MetadataSize = int64(len(t.RawInfo))
+	}
+	if listener, err := CurrentSession().Listener(); err == nil {
+		local.P = int64(listener.Port())
+	}
+	return local
+}
+
+// extensionsFor returns the extensions to announce for a torrent: every
+// local extension, except peer exchange for private torrents (BEP 27).
+func extensionsFor(t TorrentInfo) map[string]int64 {
+	if !t.Private {
+		return localExtensions
+	}
+
+	extensions := make(map[string]int64, len(localExtensions))
+	for name, id := range localExtensions {
+		if name != utPex {
+			extensions[name] = id
+		}
+	}
+	return extensions
+}
+
+// sendExtensionHandshake sends the extension handshake h to the peer.
+func sendExtensionHandshake(conn net.Conn, h ExtensionHandshake) error {
+	if h.M == nil {
+		h.M = map[string]int64{}
+	}
+
+	payload, err := Marshal(h)
+	if err != nil {
+		return err
+	}
+	return sendExtended(conn, extHandshakeID, payload)
+}
+
+// sendExtended sends an extended message with the given extended message id.
+//
+// Parameters:
+// - conn: A net.Conn representing the TCP connection to the peer.
+// - extID: The extended message id, as announced by the peer; zero is the extension handshake.
+// - payload: The payload following the extended message id.
+//
+// Returns:
+// - An error if the message could not be sent.
+func sendExtended(conn net.Conn, extID byte, payload []byte) error {
+	message := make([]byte, 6, 6+len(payload))
+	binary.BigEndian.PutUint32(message[:4], uint32(2+len(payload))) // Length of the message
+	message[4] = MsgExtended                                        // Extended message ID
+	message[5] = extID
+	message = append(message, payload...)
+
+	_, err := conn.Write(message)
+	return err
+}
+
+// readExtensionHandshake reads messages until the peer's extension handshake
+// arrives and stores it in p.Extensions. A bitfield read on the way is kept in
+// p.Bitfield; other messages are skipped.
+func (p *PeerConn) readExtensionHandshake() error {
+	for {
+		msgId, payload, err := p.receive()
+		if err != nil {
+			return err
+		}
+
+		switch msgId {
+		case MsgBitfield:
+			p.Bitfield = payload
+		case MsgExtended:
+			if len(payload) == 0 || payload[0] != extHandshakeID {
+				continue
+			}
+
+			var h ExtensionHandshake
+			decoder := NewDecoder(bytes.NewReader(payload[1:]))
+			decoder.SetLimits(peerMessageLimits)
+			if err := decoder.DecodeInto(&h); err != nil {
+				return err
+			}
+			p.Extensions = &h
+			return nil
+		}
+	}
+}
+
+// readMessage reads the next message from the peer, skipping keep alives.
+// The peer has peerReadTimeout to send it, or until p.deadline if that is
+// sooner; keep alives do not extend the time.
+//
+// Returns:
+// - A byte representing the message ID.
+// - A byte slice containing the payload following the message ID.
+// - An error if the message cannot be read in time or is too large.
+func (p *PeerConn) readMessage() (byte, []byte, error) {
+	deadline := time.Now().Add(peerReadTimeout)
+	if !p.deadline.IsZero() && p.deadline.Before(deadline) {
+		deadline = p.deadline
+	}
+	if err := p.SetReadDeadline(deadline); err != nil {
+		return 0, nil, err
+	}
+
+	for {
+		msgLen, msgId, err := readMessageHeader(p.Reader)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if msgLen == 0 {
+			continue
+		}
+
+		if msgLen > maxMessageLength {
+			return 0, nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", msgLen, maxMessageLength)
+		}
+
+		payload := make([]byte, msgLen-1)
+		if _, err := io.ReadFull(p.Reader, payload); err != nil {
+			return 0, nil, err
+		}
+		return msgId, payload, nil
+	}
+}
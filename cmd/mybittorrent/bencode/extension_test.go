@@ -0,0 +1,36 @@
+package bencode
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPeerConnReadMessageDeadline(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// The peer only ever sends keep alives, which must not extend the deadline.
+	go func() {
+		for {
+			if _, err := remote.Write([]byte{0, 0, 0, 0}); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	peer := &PeerConn{Conn: local, Reader: bufio.NewReader(local), deadline: time.Now().Add(100 * time.Millisecond)}
+	start := time.Now()
+	_, _, err := peer.readMessage()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("readMessage = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("readMessage returned after %v, want about 100ms", elapsed)
+	}
+}
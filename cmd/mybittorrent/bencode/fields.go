@@ -0,0 +1,158 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes a struct field that takes part in encoding and decoding.
+type field struct {
+	name      string // dictionary key
+	index     []int  // index sequence for reflect.Value.FieldByIndex
+	tagged    bool   // name comes from the struct tag
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the encodable fields of struct type t, sorted by key.
+func cachedFields(t reflect.Type) []field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]field)
+	}
+
+	fields, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fields.([]field)
+}
+
+// typeFields collects the fields of struct type t using the `bencode` struct tag.
+// A tag of the form "name,omitempty" renames the key and omits empty values, and
+// a tag of "-" skips the field. Untagged embedded structs are flattened into the
+// enclosing dictionary.
+//
+// Fields sharing a key are resolved like encoding/json does: the least nested
+// field wins, then a tagged one; if several fields are still left, none of
+// them is encoded or decoded.
+func typeFields(t reflect.Type) []field {
+	candidates := collectFields(t, nil, map[reflect.Type]bool{t: true})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		return a.tagged && !b.tagged
+	})
+
+	var fields []field
+	for i := 0; i < len(candidates); {
+		j := i + 1
+		for j < len(candidates) && candidates[j].name == candidates[i].name {
+			j++
+		}
+		if f, ok := dominantField(candidates[i:j]); ok {
+			fields = append(fields, f)
+		}
+		i = j
+	}
+	return fields
+}
+
+// collectFields returns every field of struct type t and of the structs it
+// embeds, whatever their keys. Embedded structs already on the path are
+// skipped, so that recursive types end.
+func collectFields(t reflect.Type, index []int, path map[reflect.Type]bool) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		fieldIndex := append(append([]int(nil), index...), i)
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if !path[ft] {
+					path[ft] = true
+					fields = append(fields, collectFields(ft, fieldIndex, path)...)
+					delete(path, ft)
+				}
+				continue
+			}
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		tagged := name != ""
+		if !tagged {
+			name = sf.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     fieldIndex,
+			tagged:    tagged,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return fields
+}
+
+// dominantField returns the field that wins among fields sharing a key,
+// sorted by depth with tagged fields first, and false if none does.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+	return fields[0], true
+}
+
+// fieldByIndex returns the field of struct v at index, allocating nil embedded
+// struct pointers along the way when alloc is set. It reports false if a nil
+// embedded pointer is found and alloc is not set, or the pointer cannot be
+// set because its field is unexported.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue reports whether v is the zero value for the purposes of omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package bencode
+
+import (
+	"reflect"
+	"testing"
+)
+
+type innerFields struct {
+	A int `bencode:"a"`
+	B int `bencode:"b"`
+	C int `bencode:"c"`
+	D int
+}
+
+type otherFields struct {
+	C int `bencode:"c"`
+	D int `bencode:"D"`
+}
+
+// outerFields embeds innerFields first, so that a field seen first does not
+// win over a less nested one.
+type outerFields struct {
+	innerFields
+	otherFields
+	A string `bencode:"a"`
+}
+
+type hiddenFields struct {
+	V int `bencode:"v"`
+}
+
+type nilEmbeddedFields struct {
+	*hiddenFields
+	W int `bencode:"w"`
+}
+
+type recursiveFields struct {
+	*recursiveFields
+	N int `bencode:"n"`
+}
+
+func TestTypeFieldsPrecedence(t *testing.T) {
+	var names []string
+	for _, f := range cachedFields(reflect.TypeOf(outerFields{})) {
+		names = append(names, f.name)
+	}
+	// c is ambiguous; D is tagged in otherFields only.
+	if want := []string{"D", "a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("fields = %v, want %v", names, want)
+	}
+
+	v := outerFields{A: "outer", innerFields: innerFields{A: 1, B: 2, C: 3, D: 4}, otherFields: otherFields{C: 5, D: 6}}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := "d1:Di6e1:a5:outer1:bi2ee"; string(data) != want {
+		t.Fatalf("Marshal = %q, want %q", data, want)
+	}
+
+	var got outerFields
+	if err := Unmarshal([]byte("d1:Di6e1:a5:outer1:bi2e1:ci3ee"), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := outerFields{A: "outer", innerFields: innerFields{B: 2}, otherFields: otherFields{D: 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unmarshal = %+v, want %+v", got, want)
+	}
+}
+
+func TestTypeFieldsRecursive(t *testing.T) {
+	var names []string
+	for _, f := range cachedFields(reflect.TypeOf(recursiveFields{})) {
+		names = append(names, f.name)
+	}
+	if want := []string{"n"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("fields = %v, want %v", names, want)
+	}
+}
+
+func TestNilUnexportedEmbeddedPointer(t *testing.T) {
+	var got nilEmbeddedFields
+	if err := Unmarshal([]byte("d1:vi1e1:wi2ee"), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got.hiddenFields != nil || got.W != 2 {
+		t.Fatalf("Unmarshal = %+v, want only w set", got)
+	}
+
+	data, err := Marshal(nilEmbeddedFields{W: 2})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := "d1:wi2ee"; string(data) != want {
+		t.Fatalf("Marshal = %q, want %q", data, want)
+	}
+
+	data, err = Marshal(nilEmbeddedFields{hiddenFields: &hiddenFields{V: 1}, W: 2})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := "d1:vi1e1:wi2ee"; string(data) != want {
+		t.Fatalf("Marshal = %q, want %q", data, want)
+	}
+}
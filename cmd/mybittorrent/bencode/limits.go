@@ -0,0 +1,93 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Limits bounds the resources a Decoder may spend on its input, so that hostile
+// data from a tracker or peer cannot exhaust the stack or memory of the client.
+// A zero field means no limit.
+type Limits struct {
+	MaxDepth        int   // maximum nesting depth of lists and dictionaries
+	MaxStringLength int64 // maximum length of a single byte string
+	MaxElements     int   // maximum number of elements in a single list or dictionary
+	MaxBytes        int64 // maximum number of bytes consumed from the input
+}
+
+// DefaultLimits are the limits of a newly created Decoder. Only the nesting
+// depth is bounded by default, as deep recursion is the one attack that cannot
+// be recovered from.
+var DefaultLimits = Limits{MaxDepth: 256}
+
+// Limits of the bencoded data peers, trackers and DHT nodes send us. Each is
+// generous for well-behaved senders while bounding what a hostile one can
+// make us allocate.
+var (
+	// trackerLimits bounds announce and scrape responses.
+	trackerLimits = Limits{MaxDepth: 32, MaxStringLength: maxTrackerResponseSize, MaxElements: 10000, MaxBytes: maxTrackerResponseSize}
+	// peerMessageLimits bounds the bencoded part of extended messages.
+	peerMessageLimits = Limits{MaxDepth: 32, MaxStringLength: maxMessageLength, MaxElements: 1000, MaxBytes: maxMessageLength}
+	// krpcLimits bounds DHT messages, which fit in a single UDP packet.
+	krpcLimits = Limits{MaxDepth: 32, MaxStringLength: dhtMaxPacketSize, MaxElements: 1000, MaxBytes: dhtMaxPacketSize}
+)
+
+// SetLimits replaces the resource limits of the decoder.
+func (d *Decoder) SetLimits(limits Limits) {
+	d.limits = limits
+}
+
+// enter records the start of a list or dictionary, enforcing MaxDepth.
+// Every successful call must be paired with a call to leave.
+func (d *Decoder) enter() error {
+	if d.limits.MaxDepth > 0 && d.depth >= d.limits.MaxDepth {
+		return &DepthLimitError{Offset: d.offset, Limit: d.limits.MaxDepth}
+	}
+	d.depth++
+	return nil
+}
+
+// leave records the end of a list or dictionary.
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// checkElements enforces MaxElements on a list or dictionary that started at
+// offset and is about to hold count elements.
+func (d *Decoder) checkElements(count int, offset int64) error {
+	if d.limits.MaxElements > 0 && count > d.limits.MaxElements {
+		return &ElementLimitError{Offset: offset, Limit: d.limits.MaxElements}
+	}
+	return nil
+}
+
+// checkStringLength enforces MaxStringLength and MaxBytes on a byte string of
+// the given length whose content starts at the current offset.
+func (d *Decoder) checkStringLength(length int64) error {
+	if d.limits.MaxStringLength > 0 && length > d.limits.MaxStringLength {
+		return &StringLimitError{Offset: d.offset, Length: length, Limit: d.limits.MaxStringLength}
+	}
+	return d.checkBytes(length)
+}
+
+// checkBytes enforces MaxBytes on consuming n more bytes of input.
+func (d *Decoder) checkBytes(n int64) error {
+	if d.limits.MaxBytes > 0 && d.offset+n > d.limits.MaxBytes {
+		return &InputLimitError{Offset: d.offset, Limit: d.limits.MaxBytes}
+	}
+	return nil
+}
+
+// unmarshalLimited decodes data into v like Unmarshal, within limits.
+func unmarshalLimited(data []byte, v interface{}, limits Limits) error {
+	decoder := NewDecoder(bytes.NewReader(data))
+	decoder.SetLimits(limits)
+	if err := decoder.DecodeInto(v); err != nil {
+		return err
+	}
+
+	if decoder.InputOffset() != int64(len(data)) {
+		return fmt.Errorf("trailing data at offset %d", decoder.InputOffset())
+	}
+	return nil
+}
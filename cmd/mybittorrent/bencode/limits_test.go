@@ -0,0 +1,57 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		input  string
+		want   interface{} // pointer to the type of error wanted; nil if decoding succeeds
+	}{
+		{"depth within limit", Limits{MaxDepth: 2}, "lli1eee", nil},
+		{"depth over limit", Limits{MaxDepth: 2}, "llli1eeee", new(*DepthLimitError)},
+		{"default depth", DefaultLimits, strings.Repeat("l", 257) + strings.Repeat("e", 257), new(*DepthLimitError)},
+		{"string within limit", Limits{MaxStringLength: 4}, "4:spam", nil},
+		{"string over limit", Limits{MaxStringLength: 3}, "4:spam", new(*StringLimitError)},
+		{"huge string length", Limits{MaxStringLength: 1 << 20}, "999999999999:x", new(*StringLimitError)},
+		{"list within limit", Limits{MaxElements: 3}, "li1ei2ei3ee", nil},
+		{"list over limit", Limits{MaxElements: 2}, "li1ei2ei3ee", new(*ElementLimitError)},
+		{"dictionary over limit", Limits{MaxElements: 1}, "d1:ai1e1:bi2ee", new(*ElementLimitError)},
+		{"input within limit", Limits{MaxBytes: 6}, "4:spam", nil},
+		{"input over limit", Limits{MaxBytes: 5}, "4:spam", new(*InputLimitError)},
+		{"long integer over limit", Limits{MaxBytes: 8}, "i1234567890e", new(*InputLimitError)},
+		{"no limits", Limits{}, strings.Repeat("l", 1000) + strings.Repeat("e", 1000), nil},
+	}
+
+	for _, tt := range tests {
+		d := NewDecoder(strings.NewReader(tt.input))
+		d.SetLimits(tt.limits)
+		_, err := d.Decode()
+
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: Decode: %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, tt.want) {
+			t.Errorf("%s: Decode = %v, want a %v", tt.name, err, reflect.TypeOf(tt.want).Elem())
+		}
+	}
+}
+
+func TestUnmarshalLimited(t *testing.T) {
+	var v map[string]interface{}
+	err := unmarshalLimited([]byte("d1:v"+strings.Repeat("l", 33)+strings.Repeat("e", 33)+"e"), &v, krpcLimits)
+
+	var depthErr *DepthLimitError
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("unmarshalLimited = %v, want a *DepthLimitError", err)
+	}
+}
@@ -0,0 +1,200 @@
+package bencode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PeerListener accepts connections from peers of the torrents added to it,
+// on the port reported to trackers. This client does not upload pieces, so
+// incoming peers are kept choked; they are served the metadata of the
+// torrent (BEP 9) and take part in peer exchange (BEP 11). It is safe for
+// concurrent use.
+type PeerListener struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	torrents map[string]listenedTorrent // by info hash, as sent in handshakes
+}
+
+// listenedTorrent is a torrent incoming peers may connect for.
+type listenedTorrent struct {
+	t    TorrentInfo
+	pool *PeerPool // pool the peers of the torrent are recorded in
+}
+
+// NewPeerListener binds a TCP listener to addr and starts accepting peers.
+//
+// Parameters:
+// - addr: The address to listen on, in the format "host:port"; port 0 picks a free port.
+//
+// Returns:
+// - A pointer to the PeerListener.
+// - An error if the address cannot be bound.
+func NewPeerListener(addr string) (*PeerListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &PeerListener{ln: ln, torrents: make(map[string]listenedTorrent)}
+	go l.serve()
+	return l, nil
+}
+
+// Addr returns the address the listener is bound to.
+func (l *PeerListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Port returns the TCP port the listener is bound to.
+func (l *PeerListener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops accepting peers. Connections already accepted are left open
+// until they fail.
+func (l *PeerListener) Close() error {
+	return l.ln.Close()
+}
+
+// Add accepts peers connecting for the torrent, under each of its info
+// hashes. Peers that report their listen port are recorded in pool as
+// connected, so that they take part in peer exchange.
+func (l *PeerListener) Add(t TorrentInfo, pool *PeerPool) error {
+	infoHashes, err := t.InfoHashes()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, infoHash := range infoHashes {
+		l.torrents[string(infoHash)] = listenedTorrent{t: t, pool: pool}
+	}
+	return nil
+}
+
+// Remove stops accepting peers connecting for the torrent.
+func (l *PeerListener) Remove(t TorrentInfo) {
+	infoHashes, err := t.InfoHashes()
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, infoHash := range infoHashes {
+		delete(l.torrents, string(infoHash))
+	}
+}
+
+// serve accepts peers until the listener is closed.
+func (l *PeerListener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+// handle performs the handshakes with an incoming peer and then answers its
+// messages until it disconnects or stays silent for peerReadTimeout. Peers
+// connecting for a torrent that was not added are disconnected.
+func (l *PeerListener) handle(conn net.Conn) {
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	if err := conn.SetReadDeadline(time.Now().Add(peerReadTimeout)); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if handshake[0] != 19 || string(handshake[1:20]) != "BitTorrent protocol" {
+		return
+	}
+
+	l.mu.Lock()
+	torrent, ok := l.torrents[string(handshake[28:48])]
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	reply, err := createHandShakeMessage(handshake[28:48], string(CurrentSession().PeerID), torrent.t.MetaVersion == 2)
+	if err != nil {
+		return
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+
+	peer := &PeerConn{
+		Conn:     conn,
+		Reader:   bufio.NewReader(conn),
+		PeerID:   handshake[48:68],
+		Reserved: handshake[20:28],
+		Addr:     conn.RemoteAddr().String(),
+		Metadata: torrent.t.RawInfo,
+		Private:  torrent.t.Private,
+	}
+
+	if peer.SupportsExtensions() {
+		if err := sendExtensionHandshake(conn, localExtensionHandshake(torrent.t)); err != nil {
+			return
+		}
+		if err := peer.readExtensionHandshake(); err != nil {
+			return
+		}
+
+		// Only the port the peer listens on is of use to other peers.
+		if port := peer.Extensions.P; port > 0 && port <= 65535 {
+			host, _, err := net.SplitHostPort(peer.Addr)
+			if err != nil {
+				return
+			}
+			peer.Addr = net.JoinHostPort(host, strconv.FormatInt(port, 10))
+			peer.Pool = torrent.pool
+
+			torrent.pool.Connected(peer.Addr)
+			defer torrent.pool.Dropped(peer.Addr)
+		}
+	}
+
+	for {
+		if err := peer.sendPexUpdate(); err != nil {
+			return
+		}
+		if _, _, err := peer.receive(); err != nil {
+			return
+		}
+	}
+}
+
+// Listener returns the listener accepting peers for the session, binding it
+// on first use. If Port is taken, a free port is bound instead, and Port is
+// set to the port actually bound.
+func (s *Session) Listener() (*PeerListener, error) {
+	s.listenOnce.Do(func() {
+		s.listener, s.listenErr = NewPeerListener(fmt.Sprintf(":%d", s.Port))
+		if s.listenErr != nil {
+			s.listener, s.listenErr = NewPeerListener(":0")
+		}
+		if s.listenErr == nil {
+			s.Port = s.listener.Port()
+		}
+	})
+	return s.listener, s.listenErr
+}
@@ -0,0 +1,58 @@
+package bencode
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestPeerListener(t *testing.T) {
+	l, err := NewPeerListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPeerListener: %v", err)
+	}
+	defer l.Close()
+
+	info := hybridInfo(t, bytes.Repeat([]byte("listen"), 1000))
+	torrent, err := torrentFromMetadata(Magnet{InfoHash: calculateInfoHash(info), InfoHashV2: calculateInfoHashV2(info)}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := HandShakeWithPeer(*torrent, l.Addr().String()); err == nil {
+		t.Fatal("HandShakeWithPeer succeeded for a torrent not added to the listener")
+	}
+
+	pool := NewPeerPool()
+	if err := l.Add(*torrent, pool); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	peer, err := ExtendedHandShakeWithPeer(*torrent, l.Addr().String())
+	if err != nil {
+		t.Fatalf("ExtendedHandShakeWithPeer: %v", err)
+	}
+	defer peer.Close()
+
+	if peer.Extensions == nil || peer.Extensions.MetadataSize != int64(len(info)) {
+		t.Fatalf("extension handshake = %+v, want metadata size %d", peer.Extensions, len(info))
+	}
+	piece, err := requestMetadataPiece(peer, 0, int64(len(info)))
+	if err != nil {
+		t.Fatalf("requestMetadataPiece: %v", err)
+	}
+	if !bytes.Equal(piece, info) {
+		t.Fatalf("metadata piece = %q, want %q", piece, info)
+	}
+
+	// We report our listen port, so the listener records us as a peer.
+	want := "127.0.0.1:" + strconv.Itoa(CurrentSession().Port)
+	if added, _ := pool.pexLists(""); len(added) != 1 || added[0] != want {
+		t.Fatalf("connected peers = %v, want [%s]", added, want)
+	}
+
+	l.Remove(*torrent)
+	if _, _, err := HandShakeWithPeer(*torrent, l.Addr().String()); err == nil {
+		t.Fatal("HandShakeWithPeer succeeded for a torrent removed from the listener")
+	}
+}
@@ -0,0 +1,397 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Magnet is a parsed magnet link (BEP 9). A magnet link names a torrent by its
+// info hash; everything else about the torrent is learned from peers.
+type Magnet struct {
+	InfoHash   string      // hex SHA-1 info hash from "xt=urn:btih:"; empty for v2-only links
+	InfoHashV2 string      // hex SHA-256 info hash from "xt=urn:btmh:" (BEP 52); empty for v1 links
+	Name       string      // "dn", the display name
+	Trackers   []string    // "tr", tracker URLs
+	WebSeeds   []string    // "ws", web seed URLs (BEP 19)
+	Peers      []string    // "x.pe", peer addresses in the format "host:port"
+	SelectOnly []FileRange // "so", ranges of indices of the files to download (BEP 53); nil selects every file
+}
+
+// FileRange is a range of file indices, both ends included.
+type FileRange struct {
+	First, Last int
+}
+
+// maxSelectOnlyRanges bounds the ranges a magnet link may select files with.
+const maxSelectOnlyRanges = 1024
+
+// multihashSHA256 is the multihash prefix of a SHA-256 digest: the function
+// code 0x12 followed by the digest length.
+const multihashSHA256 = "1220"
+
+// ParseMagnet parses a magnet link.
+// Parameters may carry a numeric suffix ("xt.1", "tr.2") as some clients
+// write them; values of the same parameter are kept in the order given.
+//
+// Parameters:
+// - uri: A string containing the magnet link.
+//
+// Returns:
+// - A pointer to a Magnet struct holding the parsed link.
+// - An error if the link is malformed or carries no BitTorrent info hash.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("invalid magnet link: scheme %q", u.Scheme)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+
+	m := &Magnet{}
+	for _, xt := range magnetParam(query, "xt") {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			m.InfoHash, err = parseBTIH(strings.TrimPrefix(xt, "urn:btih:"))
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			m.InfoHashV2, err = parseBTMH(strings.TrimPrefix(xt, "urn:btmh:"))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.InfoHash == "" && m.InfoHashV2 == "" {
+		return nil, fmt.Errorf("invalid magnet link: missing info hash")
+	}
+
+	if names := magnetParam(query, "dn"); len(names) > 0 {
+		m.Name = names[0]
+	}
+	m.Trackers = magnetParam(query, "tr")
+	m.WebSeeds = magnetParam(query, "ws")
+	m.Peers = magnetParam(query, "x.pe")
+
+	for _, so := range magnetParam(query, "so") {
+		ranges, err := parseSelectOnly(so)
+		if err != nil {
+			return nil, err
+		}
+		m.SelectOnly = append(m.SelectOnly, ranges...)
+	}
+	if len(m.SelectOnly) > maxSelectOnlyRanges {
+		return nil, fmt.Errorf("invalid magnet link: more than %d so ranges", maxSelectOnlyRanges)
+	}
+
+	return m, nil
+}
+
+// magnetParam returns the values of key in query, followed by those of its
+// numbered variants "key.1", "key.2" and so on.
+func magnetParam(query url.Values, key string) []string {
+	values := append([]string(nil), query[key]...)
+
+	var numbered []string
+	for k := range query {
+		suffix, ok := strings.CutPrefix(k, key+".")
+		if !ok {
+			continue
+		}
+		if _, err := strconv.Atoi(suffix); err == nil {
+			numbered = append(numbered, k)
+		}
+	}
+
+	sort.Slice(numbered, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(numbered[i], key+"."))
+		b, _ := strconv.Atoi(strings.TrimPrefix(numbered[j], key+"."))
+		return a < b
+	})
+
+	for _, k := range numbered {
+		values = append(values, query[k]...)
+	}
+	return values
+}
+
+// parseBTIH decodes a v1 info hash, given as 40 hex digits or 32 base32 characters.
+func parseBTIH(s string) (string, error) {
+	switch len(s) {
+	case 2 * sha1.Size:
+		infoHash, err := hex.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid btih %q: %w", s, err)
+		}
+		return hex.EncodeToString(infoHash), nil
+	case 32:
+		infoHash, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return "", fmt.Errorf("invalid btih %q: %w", s, err)
+		}
+		return hex.EncodeToString(infoHash), nil
+	default:
+		return "", fmt.Errorf("invalid btih %q", s)
+	}
+}
+
+// parseBTMH decodes a v2 info hash, given as a hex SHA-256 multihash.
+func parseBTMH(s string) (string, error) {
+	digest, ok := strings.CutPrefix(strings.ToLower(s), multihashSHA256)
+	if !ok || len(digest) != 2*sha256.Size {
+		return "", fmt.Errorf("invalid btmh %q", s)
+	}
+
+	infoHash, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid btmh %q: %w", s, err)
+	}
+	return hex.EncodeToString(infoHash), nil
+}
+
+// parseSelectOnly parses a "so" value such as "0,2,4-6" into ranges of file
+// indices. Ranges are kept as given, since they may be far larger than the
+// torrent's real file list; see Magnet.SelectedFiles.
+func parseSelectOnly(s string) ([]FileRange, error) {
+	var ranges []FileRange
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid so %q", s)
+		}
+
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(to)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid so %q", s)
+			}
+		}
+
+		ranges = append(ranges, FileRange{First: first, Last: last})
+	}
+	return ranges, nil
+}
+
+// SelectedFiles returns the indices of the files the link selects among the
+// fileCount files of its torrent, in ascending order and without duplicates.
+//
+// Parameters:
+// - fileCount: The number of files in the torrent.
+//
+// Returns:
+// - The indices of the selected files, or nil if the link selects every file.
+func (m Magnet) SelectedFiles(fileCount int) []int {
+	if m.SelectOnly == nil {
+		return nil
+	}
+
+	selected := make([]bool, fileCount)
+	for _, r := range m.SelectOnly {
+		for i := r.First; i <= min(r.Last, fileCount-1); i++ {
+			selected[i] = true
+		}
+	}
+
+	indices := []int{}
+	for i, ok := range selected {
+		if ok {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// PrintStats prints the contents of the magnet link.
+func (m Magnet) PrintStats() {
+	var tracker string
+	if len(m.Trackers) > 0 {
+		tracker = m.Trackers[0]
+	}
+
+	fmt.Printf("Tracker URL: %v\n", tracker)
+	fmt.Printf("Info Hash: %v\n", m.InfoHash)
+
+	if m.InfoHashV2 != "" {
+		fmt.Printf("Info Hash v2: %v\n", m.InfoHashV2)
+	}
+	if m.Name != "" {
+		fmt.Printf("Name: %v\n", m.Name)
+	}
+	for _, tracker := range m.Trackers[min(1, len(m.Trackers)):] {
+		fmt.Printf("Tracker: %v\n", tracker)
+	}
+	for _, seed := range m.WebSeeds {
+		fmt.Printf("Web Seed: %v\n", seed)
+	}
+	for _, peer := range m.Peers {
+		fmt.Printf("Peer: %v\n", peer)
+	}
+	if len(m.SelectOnly) > 0 {
+		ranges := make([]string, len(m.SelectOnly))
+		for i, r := range m.SelectOnly {
+			ranges[i] = strconv.Itoa(r.First)
+			if r.Last != r.First {
+				ranges[i] += "-" + strconv.Itoa(r.Last)
+			}
+		}
+		fmt.Printf("Select Only: %v\n", strings.Join(ranges, ","))
+	}
+}
+
+// torrentInfo returns the partial TorrentInfo known from the magnet link
+// alone: enough to announce to its trackers and handshake with peers, but
+// without the info dictionary needed to download.
+func (m Magnet) torrentInfo() TorrentInfo {
+	t := TorrentInfo{
+		Name:        m.Name,
+		URLList:     m.WebSeeds,
+		InfoHash:    m.InfoHash,
+		InfoHashV2:  m.InfoHashV2,
+		MetaVersion: 1,
+	}
+
+	if m.InfoHashV2 != "" {
+		t.MetaVersion = 2
+	}
+
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+	}
+	// Every tracker of the link is announced to, each in a tier of its own.
+	if len(m.Trackers) > 1 {
+		for _, tracker := range m.Trackers {
+			t.AnnounceList = append(t.AnnounceList, []string{tracker})
+		}
+	}
+	return t
+}
+
+// MagnetPeers returns the peers a magnet link leads to: the peers listed in
+// the link itself, followed by those its trackers report.
+//
+// Parameters:
+// - m: A Magnet struct holding the parsed link.
+//
+// Returns:
+// - A slice of strings, each representing a peer in the format "IP:port".
+// - An error if the link lists no peers and no tracker could be reached.
+func MagnetPeers(m Magnet) ([]string, error) {
+	peers := append([]string(nil), m.Peers...)
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		seen[peer] = true
+	}
+
+	var lastErr error
+	if len(m.Trackers) > 0 {
+		trackers := NewTrackerManager(m.torrentInfo())
+		trackers.Parallel = true
+
+		var found []string
+		found, lastErr = trackers.Announce(EventNone)
+		for _, peer := range found {
+			if !seen[peer] {
+				seen[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	if len(peers) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("magnet link lists no trackers or peers")
+		}
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// MagnetHandShake connects to the first peer a magnet link leads to that
+// completes the BitTorrent handshake and, if it supports the extension
+// protocol, the extension handshake.
+//
+// Parameters:
+// - m: A Magnet struct holding the parsed link.
+//
+// Returns:
+// - A pointer to a PeerConn holding the connection and the negotiated extensions.
+// - An error if no peer could be reached.
+func MagnetHandShake(m Magnet) (*PeerConn, error) {
+	peers, err := MagnetPeers(m)
+	if err != nil {
+		return nil, err
+	}
+
+	t := m.torrentInfo()
+	for _, addr := range peers {
+		var peer *PeerConn
+		peer, err = ExtendedHandShakeWithPeer(t, addr)
+		if err == nil {
+			return peer, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to connect to any peers: %w", err)
+}
+
+// ResolveMagnet builds the TorrentInfo a magnet link refers to by fetching the
+// info dictionary from the torrent's peers (BEP 9). The trackers and web seeds
+// of the link carry over to the torrent. Piece layers are not part of the info
+// dictionary: pieces of hybrid torrents are verified against their v1 hashes
+// instead, and v2-only torrents with files larger than a piece cannot be
+// resolved this way.
+//
+// Parameters:
+// - m: A Magnet struct holding the parsed link.
+//
+// Returns:
+// - A pointer to a TorrentInfo struct for the torrent.
+// - An error if no peer provides the info dictionary, or if the torrent needs piece layers.
+func ResolveMagnet(m Magnet) (*TorrentInfo, error) {
+	peers, err := MagnetPeers(m)
+	if err != nil {
+		return nil, err
+	}
+
+	t := m.torrentInfo()
+	rawInfo, err := FetchMetadata(t, peers)
+	if err != nil {
+		return nil, err
+	}
+	return torrentFromMetadata(m, rawInfo)
+}
+
+// torrentFromMetadata builds the TorrentInfo of a magnet link from the info
+// dictionary fetched for it, which carries no piece layers.
+func torrentFromMetadata(m Magnet, rawInfo []byte) (*TorrentInfo, error) {
+	t := m.torrentInfo()
+	t.RawInfo = rawInfo
+
+	var buf bytes.Buffer
+	if err := WriteTorrent(t, &buf); err != nil {
+		return nil, err
+	}
+
+	parser := CreateParser(&buf)
+	parser.SetWithoutPieceLayers(true)
+	torrent, err := parser.ParseTorrent()
+	if errors.Is(err, ErrMissingPieceLayer) {
+		return nil, fmt.Errorf("v2-only torrents need piece layers, which are not part of the metadata: %w", err)
+	}
+	return torrent, err
+}
@@ -0,0 +1,192 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testInfoHash = "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"
+
+func TestParseMagnet(t *testing.T) {
+	v2 := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		uri  string
+		want *Magnet // nil if parsing fails
+	}{
+		{
+			"magnet:?xt=urn:btih:" + testInfoHash + "&dn=sample.txt&tr=http%3A%2F%2Ftracker.example%2Fannounce",
+			&Magnet{InfoHash: testInfoHash, Name: "sample.txt", Trackers: []string{"http://tracker.example/announce"}},
+		},
+		{
+			"magnet:?xt=urn:btih:22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7",
+			&Magnet{InfoHash: testInfoHash},
+		},
+		{
+			"magnet:?xt=urn:btih:" + strings.ToUpper(testInfoHash),
+			&Magnet{InfoHash: testInfoHash},
+		},
+		{
+			"magnet:?xt=urn:btmh:1220" + v2,
+			&Magnet{InfoHashV2: v2},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testInfoHash + "&xt=urn:btmh:1220" + v2,
+			&Magnet{InfoHash: testInfoHash, InfoHashV2: v2},
+		},
+		{
+			"magnet:?xt.1=urn:btih:" + testInfoHash + "&tr.2=udp%3A%2F%2Fb&tr.1=udp%3A%2F%2Fa&tr=udp%3A%2F%2Fc",
+			&Magnet{InfoHash: testInfoHash, Trackers: []string{"udp://c", "udp://a", "udp://b"}},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testInfoHash + "&ws=http%3A%2F%2Fseed.example%2F&x.pe=10.0.0.1%3A6881",
+			&Magnet{InfoHash: testInfoHash, WebSeeds: []string{"http://seed.example/"}, Peers: []string{"10.0.0.1:6881"}},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testInfoHash + "&so=0,2,4-6&so=9",
+			&Magnet{InfoHash: testInfoHash, SelectOnly: []FileRange{{0, 0}, {2, 2}, {4, 6}, {9, 9}}},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testInfoHash + "&so=4-2000000000",
+			&Magnet{InfoHash: testInfoHash, SelectOnly: []FileRange{{4, 2000000000}}},
+		},
+		{"http://example.com/?xt=urn:btih:" + testInfoHash, nil},
+		{"magnet:?dn=no+hash", nil},
+		{"magnet:?xt=urn:btih:1234", nil},
+		{"magnet:?xt=urn:btih:" + strings.Repeat("zz", 20), nil},
+		{"magnet:?xt=urn:btmh:1114" + v2, nil},
+		{"magnet:?xt=urn:btih:" + testInfoHash + "&so=2-1", nil},
+		{"magnet:?xt=urn:btih:" + testInfoHash + "&so=-1", nil},
+		{"magnet:?xt=urn:btih:" + testInfoHash + "&so=a", nil},
+		{"magnet:?xt=urn:btih:" + testInfoHash + "&so=" + strings.Repeat("1,", maxSelectOnlyRanges) + "1", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMagnet(tt.uri)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseMagnet(%q) = %+v, want an error", tt.uri, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseMagnet(%q): %v", tt.uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMagnet(%q) = %+v, want %+v", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestMagnetSelectedFiles(t *testing.T) {
+	tests := []struct {
+		selectOnly []FileRange
+		fileCount  int
+		want       []int
+	}{
+		{nil, 5, nil},
+		{[]FileRange{{0, 0}, {2, 3}}, 5, []int{0, 2, 3}},
+		{[]FileRange{{3, 3}, {1, 3}}, 5, []int{1, 2, 3}},
+		{[]FileRange{{4, 2000000000}}, 6, []int{4, 5}},
+		{[]FileRange{{10, 12}}, 5, []int{}},
+	}
+
+	for _, tt := range tests {
+		got := Magnet{SelectOnly: tt.selectOnly}.SelectedFiles(tt.fileCount)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SelectedFiles(%d) with so %v = %v, want %v", tt.fileCount, tt.selectOnly, got, tt.want)
+		}
+	}
+}
+
+// hybridInfo returns the info dictionary of a single-file hybrid torrent of
+// data, with pieces of one block.
+func hybridInfo(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var pieces []byte
+	var nodes []merkleHash
+	for start := 0; start < len(data); start += BlockSize {
+		piece := data[start:min(start+BlockSize, len(data))]
+		hash := sha1.Sum(piece)
+		pieces = append(pieces, hash[:]...)
+
+		nodes = append(nodes, pieceRoot(piece, 1, false))
+	}
+	root := merkleRoot(nodes, nextPowerOfTwo(len(nodes)), padHash(1))
+
+	info, err := Marshal(map[string]interface{}{
+		"file tree":    map[string]interface{}{"a.bin": map[string]interface{}{"": map[string]interface{}{"length": len(data), "pieces root": root[:]}}},
+		"length":       len(data),
+		"meta version": 2,
+		"name":         "a.bin",
+		"piece length": BlockSize,
+		"pieces":       pieces,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestTorrentFromMetadataHybrid(t *testing.T) {
+	data := make([]byte, 2*BlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	info := hybridInfo(t, data)
+
+	m := Magnet{InfoHash: calculateInfoHash(info), InfoHashV2: calculateInfoHashV2(info)}
+	torrent, err := torrentFromMetadata(m, info)
+	if err != nil {
+		t.Fatalf("torrentFromMetadata: %v", err)
+	}
+	if torrent.PieceCount() != 3 || len(torrent.PieceLayers) != 0 {
+		t.Fatalf("torrentFromMetadata = %d pieces, %d piece layers; want 3 pieces, no piece layers", torrent.PieceCount(), len(torrent.PieceLayers))
+	}
+
+	for i := 0; i < torrent.PieceCount(); i++ {
+		piece := data[i*BlockSize : min((i+1)*BlockSize, len(data))]
+		if !torrent.verifyPiece(i, piece) {
+			t.Errorf("verifyPiece(%d) rejected a valid piece", i)
+		}
+
+		corrupt := append([]byte(nil), piece...)
+		corrupt[0] ^= 1
+		if torrent.verifyPiece(i, corrupt) {
+			t.Errorf("verifyPiece(%d) accepted a corrupt piece", i)
+		}
+	}
+
+	// Torrent files must still carry their piece layers.
+	var buf bytes.Buffer
+	if err := WriteTorrent(*torrent, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateParser(&buf).ParseTorrent(); !errors.Is(err, ErrMissingPieceLayer) {
+		t.Fatalf("ParseTorrent without piece layers = %v, want %v", err, ErrMissingPieceLayer)
+	}
+}
+
+func TestTorrentFromMetadataV2Only(t *testing.T) {
+	info, err := Marshal(map[string]interface{}{
+		"file tree":    map[string]interface{}{"a.bin": map[string]interface{}{"": map[string]interface{}{"length": 2 * BlockSize, "pieces root": make([]byte, 32)}}},
+		"meta version": 2,
+		"name":         "a.bin",
+		"piece length": BlockSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Magnet{InfoHashV2: calculateInfoHashV2(info)}
+	if _, err := torrentFromMetadata(m, info); !errors.Is(err, ErrMissingPieceLayer) {
+		t.Fatalf("torrentFromMetadata = %v, want %v", err, ErrMissingPieceLayer)
+	}
+}
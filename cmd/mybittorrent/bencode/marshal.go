@@ -0,0 +1,54 @@
+package bencode
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+)
+
+// Marshaler is implemented by types that can encode themselves into valid bencode.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// RawMessage is a raw encoded bencode value. It can be used to delay decoding
+// of part of a message or to embed a precomputed encoding.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencoding of m.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, &MarshalerError{Type: reflect.TypeOf(m), Err: errEmptyRawMessage}
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data.
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	bigIntType      = reflect.TypeOf(big.Int{})
+)
+
+// Marshal returns the bencoding of v.
+//
+// Integers of every width and big.Int values are encoded as bencode integers,
+// and bools as the integers 0 and 1. Strings, byte slices and byte arrays are
+// encoded as byte strings, slices and arrays as lists, and maps with string
+// keys and structs as dictionaries with sorted keys. Struct fields are named by
+// their `bencode:"name,omitempty"` tag; fields tagged "-" are skipped.
+// Pointers and interfaces encode the value they point to. Since bencode has no
+// null value, nil pointers, interfaces and maps inside a dictionary are
+// omitted, and anywhere else they are an error.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,153 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// BitTorrent v2 (BEP 52) hashes each file on its own with a SHA-256 merkle
+// tree whose leaves are the hashes of the file's 16KB blocks. The number of
+// leaves is padded to a power of two with zero hashes, and each file's root
+// is stored in the info dictionary as its "pieces root". For files larger than
+// a piece, the layer of the tree whose nodes cover exactly one piece is stored
+// in the top-level "piece layers" dictionary, keyed by the file's root.
+
+// merkleHash is a node of a v2 merkle tree.
+type merkleHash = [sha256.Size]byte
+
+// blockHashes returns the leaf hashes of data, one per 16KB block.
+func blockHashes(data []byte) []merkleHash {
+	hashes := make([]merkleHash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for start := 0; start < len(data); start += BlockSize {
+		hashes = append(hashes, sha256.Sum256(data[start:min(start+BlockSize, len(data))]))
+	}
+	return hashes
+}
+
+// merkleRoot computes the root of a tree with width leaves, the first of which
+// are nodes and the rest pad. Width must be a power of two no smaller than
+// len(nodes).
+func merkleRoot(nodes []merkleHash, width int, pad merkleHash) merkleHash {
+	layer := make([]merkleHash, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		next := layer[:len(layer)/2]
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// hashPair returns the parent of two sibling nodes.
+func hashPair(left, right merkleHash) merkleHash {
+	var pair [2 * sha256.Size]byte
+	copy(pair[:sha256.Size], left[:])
+	copy(pair[sha256.Size:], right[:])
+	return sha256.Sum256(pair[:])
+}
+
+// padHash returns the root of a subtree of width zero leaves, the value that
+// pads a layer whose nodes each cover width blocks.
+func padHash(width int) merkleHash {
+	var zero merkleHash
+	return merkleRoot(nil, width, zero)
+}
+
+// nextPowerOfTwo returns the smallest power of two that is at least n.
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// pieceRoot returns the root of the subtree covering one piece of a file.
+// Pieces of files larger than a piece are padded to blocksPerPiece leaves; a
+// file that fits in one piece is hashed as a whole, padded only to the next
+// power of two.
+func pieceRoot(piece []byte, blocksPerPiece int, wholeFile bool) merkleHash {
+	leaves := blockHashes(piece)
+	width := blocksPerPiece
+	if wholeFile {
+		width = nextPowerOfTwo(len(leaves))
+	}
+
+	var zero merkleHash
+	return merkleRoot(leaves, width, zero)
+}
+
+// verifyPieceLayer checks that the piece layer of a file of the given length
+// hashes up to the file's pieces root.
+//
+// Parameters:
+// - layer: The concatenated SHA-256 hashes of the file's pieces.
+// - root: The file's pieces root.
+// - length: The length of the file in bytes.
+// - pieceLength: The piece length of the torrent.
+//
+// Returns:
+// - An error if the layer has the wrong size or does not match the root.
+func verifyPieceLayer(layer, root []byte, length, pieceLength int64) error {
+	pieceCnt := int((length + pieceLength - 1) / pieceLength)
+	if len(layer) != pieceCnt*sha256.Size {
+		return fmt.Errorf("expected %d piece layer hashes but got %d bytes", pieceCnt, len(layer))
+	}
+
+	nodes := make([]merkleHash, pieceCnt)
+	for i := range nodes {
+		copy(nodes[i][:], layer[i*sha256.Size:])
+	}
+
+	blocksPerPiece := int(pieceLength / BlockSize)
+	computed := merkleRoot(nodes, nextPowerOfTwo(pieceCnt), padHash(blocksPerPiece))
+	if !bytes.Equal(computed[:], root) {
+		return fmt.Errorf("piece layer does not match pieces root")
+	}
+	return nil
+}
+
+// verifyPieceV2 checks a downloaded piece against the merkle tree of the file
+// it belongs to: against the file's piece layer if the file spans several
+// pieces, or against its pieces root otherwise.
+//
+// Parameters:
+// - t: A TorrentInfo struct of a v2 or hybrid torrent.
+// - pieceIndex: The index of the piece.
+// - piece: The piece data.
+//
+// Returns:
+// - true if the piece is valid.
+func verifyPieceV2(t TorrentInfo, pieceIndex int, piece []byte) bool {
+	start := int64(pieceIndex) * t.PieceLength
+	file, ok := t.fileAt(start)
+	if !ok || file.PiecesRoot == nil {
+		return false
+	}
+
+	// In a hybrid torrent the v1 view of a file's last piece is followed by
+	// padding, which is not part of the v2 tree.
+	piece = piece[:min(int64(len(piece)), file.Offset+file.Length-start)]
+
+	blocksPerPiece := int(t.PieceLength / BlockSize)
+	if file.Length <= t.PieceLength {
+		root := pieceRoot(piece, blocksPerPiece, true)
+		return bytes.Equal(root[:], file.PiecesRoot)
+	}
+
+	layer := t.PieceLayers[string(file.PiecesRoot)]
+	k := int((start - file.Offset) / t.PieceLength)
+	if (k+1)*sha256.Size > len(layer) {
+		return false
+	}
+
+	root := pieceRoot(piece, blocksPerPiece, false)
+	return bytes.Equal(root[:], layer[k*sha256.Size:(k+1)*sha256.Size])
+}
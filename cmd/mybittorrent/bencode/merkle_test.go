@@ -0,0 +1,94 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// sha256Of returns the SHA-256 hash of the concatenated parts.
+func sha256Of(parts ...[]byte) []byte {
+	sum := sha256.Sum256(bytes.Join(parts, nil))
+	return sum[:]
+}
+
+// testBlocks returns n bytes of data, varying from block to block.
+func testBlocks(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i/BlockSize + i*13)
+	}
+	return data
+}
+
+func TestVerifyPieceV2(t *testing.T) {
+	const pieceLength = 2 * BlockSize
+	zero := make([]byte, sha256.Size)
+
+	// a spans three pieces; its last one holds a single block, padded with a
+	// zero leaf, and the layer is padded with the root of two zero leaves.
+	a := testBlocks(4*BlockSize + 100)
+	var blocks [][]byte
+	for start := 0; start < len(a); start += BlockSize {
+		blocks = append(blocks, sha256Of(a[start:min(start+BlockSize, len(a))]))
+	}
+	layer := [][]byte{
+		sha256Of(blocks[0], blocks[1]),
+		sha256Of(blocks[2], blocks[3]),
+		sha256Of(blocks[4], zero),
+	}
+	rootA := sha256Of(sha256Of(layer[0], layer[1]), sha256Of(layer[2], sha256Of(zero, zero)))
+
+	// b fits in one piece: its root covers its two blocks only.
+	b := testBlocks(BlockSize + 10)
+	rootB := sha256Of(sha256Of(b[:BlockSize]), sha256Of(b[BlockSize:]))
+
+	// c fits in one block: its root is the hash of that block.
+	c := testBlocks(100)
+	rootC := sha256Of(c)
+
+	if err := verifyPieceLayer(bytes.Join(layer, nil), rootA, int64(len(a)), pieceLength); err != nil {
+		t.Fatalf("verifyPieceLayer: %v", err)
+	}
+	if err := verifyPieceLayer(bytes.Join(layer[:2], nil), rootA, int64(len(a)), pieceLength); err == nil {
+		t.Fatal("verifyPieceLayer accepted a layer missing a piece")
+	}
+	if err := verifyPieceLayer(bytes.Join([][]byte{layer[1], layer[0], layer[2]}, nil), rootA, int64(len(a)), pieceLength); err == nil {
+		t.Fatal("verifyPieceLayer accepted a layer with swapped pieces")
+	}
+
+	torrent := TorrentInfo{
+		MetaVersion: 2,
+		PieceLength: pieceLength,
+		Files: []File{
+			{Path: []string{"a"}, Length: int64(len(a)), Offset: 0, PiecesRoot: rootA},
+			{Path: []string{"b"}, Length: int64(len(b)), Offset: 3 * pieceLength, PiecesRoot: rootB},
+			{Path: []string{"c"}, Length: int64(len(c)), Offset: 4 * pieceLength, PiecesRoot: rootC},
+		},
+		PieceLayers: map[string][]byte{string(rootA): bytes.Join(layer, nil)},
+	}
+
+	// The last piece of a file is also checked followed by the padding of a
+	// hybrid torrent's v1 view.
+	lastOfA := append(append([]byte(nil), a[2*pieceLength:]...), make([]byte, 3*pieceLength-len(a))...)
+	pieces := [][]byte{a[:pieceLength], a[pieceLength : 2*pieceLength], a[2*pieceLength:], lastOfA, b, c}
+	indices := []int{0, 1, 2, 2, 3, 4}
+	for i, piece := range pieces {
+		if !verifyPieceV2(torrent, indices[i], piece) {
+			t.Errorf("verifyPieceV2(%d) rejected valid piece %d", indices[i], i)
+		}
+
+		corrupt := append([]byte(nil), piece...)
+		corrupt[0] ^= 1
+		if verifyPieceV2(torrent, indices[i], corrupt) {
+			t.Errorf("verifyPieceV2(%d) accepted corrupt piece %d", indices[i], i)
+		}
+	}
+
+	if verifyPieceV2(torrent, 0, a[pieceLength:2*pieceLength]) {
+		t.Error("verifyPieceV2(0) accepted piece 1")
+	}
+	if verifyPieceV2(torrent, 5, c) {
+		t.Error("verifyPieceV2(5) accepted a piece past the last file")
+	}
+}
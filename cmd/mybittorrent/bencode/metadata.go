@@ -0,0 +1,360 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	utMetadata         = "ut_metadata"
+	utMetadataID       = 1         // extended message id peers send ut_metadata messages to us under
+	metadataPieceSize  = 16 * 1024 // 16KB
+	maxMetadataSize    = 16 * 1024 * 1024
+	maxMetadataPeers   = 5 // peers metadata is fetched from at once
+	metadataReqTimeout = 30 * time.Second
+)
+
+// ut_metadata message types (BEP 9).
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+func init() {
+	localExtensions[utMetadata] = utMetadataID
+}
+
+// metadataMessage is the bencoded header of a ut_metadata message. In a data
+// message it is followed by the bytes of the piece.
+type metadataMessage struct {
+	MsgType   int64 `bencode:"msg_type"`
+	Piece     int64 `bencode:"piece"`
+	TotalSize int64 `bencode:"total_size,omitempty"`
+}
+
+// FetchMetadata downloads the info dictionary of a torrent from its peers
+// using the metadata extension (BEP 9). The dictionary is split into 16KB
+// pieces, which are requested from up to five peers at once; a piece a peer
+// fails to deliver is handed to another peer. The assembled dictionary is
+// checked against the torrent's info hash. If it does not match, some peer
+// sent a bad piece, so each peer is trusted in turn: the pieces the other
+// peers delivered are fetched again from it, until the dictionary matches.
+//
+// Parameters:
+// - t: A TorrentInfo struct holding at least the info hash of the torrent.
+// - peers: The addresses of the peers to ask, in the format "IP:port".
+//
+// Returns:
+// - A byte slice containing the bencoded info dictionary.
+// - An error if no set of peers provides a dictionary matching the info hash.
+func FetchMetadata(t TorrentInfo, peers []string) ([]byte, error) {
+	conns, size, err := connectMetadataPeers(t, peers)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	pieceCnt := int((size + metadataPieceSize - 1) / metadataPieceSize)
+	metadata := make([]byte, size)
+	sources := make([]*PeerConn, pieceCnt)
+	failed := make(map[*PeerConn]bool)
+	if err := fetchMetadataPieces(conns, failed, metadata, sources); err != nil {
+		return nil, err
+	}
+
+	verifyErr := verifyMetadata(t, metadata)
+	if verifyErr == nil {
+		return metadata, nil
+	}
+
+	for _, peer := range conns {
+		if failed[peer] {
+			continue
+		}
+
+		candidate := append([]byte(nil), metadata...)
+		complete := true
+		for index, source := range sources {
+			if source == peer {
+				continue
+			}
+
+			piece, err := requestMetadataPiece(peer, index, size)
+			if err != nil {
+				complete = false
+				break
+			}
+			copy(candidate[index*metadataPieceSize:], piece)
+		}
+
+		if complete && verifyMetadata(t, candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return nil, verifyErr
+}
+
+// fetchMetadataPieces fetches every piece of the metadata from the peers at
+// once, recording which peer delivered each piece in sources. A peer that
+// fails is added to failed and its piece handed to another peer.
+func fetchMetadataPieces(conns []*PeerConn, failed map[*PeerConn]bool, metadata []byte, sources []*PeerConn) error {
+	size := int64(len(metadata))
+	pending := make(chan int, len(sources))
+	for index := range sources {
+		pending <- index
+	}
+
+	var mu sync.Mutex
+	var lastErr error
+	remaining := len(sources)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(peer *PeerConn) {
+			defer wg.Done()
+			for {
+				var index int
+				select {
+				case index = <-pending:
+				case <-done:
+					return
+				}
+
+				piece, err := requestMetadataPiece(peer, index, size)
+				if err != nil {
+					pending <- index
+					mu.Lock()
+					lastErr = err
+					failed[peer] = true
+					mu.Unlock()
+					return
+				}
+
+				mu.Lock()
+				copy(metadata[index*metadataPieceSize:], piece)
+				sources[index] = peer
+				remaining--
+				if remaining == 0 {
+					close(done)
+				}
+				mu.Unlock()
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	if remaining > 0 {
+		return fmt.Errorf("error fetching metadata: %w", lastErr)
+	}
+	return nil
+}
+
+// metadataPiece returns the piece of the metadata with the given index.
+func metadataPiece(metadata []byte, index int) []byte {
+	start := index * metadataPieceSize
+	return metadata[start:min(start+metadataPieceSize, len(metadata))]
+}
+
+// connectMetadataPeers connects to up to maxMetadataPeers peers supporting
+// the metadata extension. Peers announcing a different metadata size than the
+// first one are dropped.
+func connectMetadataPeers(t TorrentInfo, peers []string) ([]*PeerConn, int64, error) {
+	var conns []*PeerConn
+	var size int64
+	lastErr := fmt.Errorf("no peers to fetch metadata from")
+	for _, addr := range peers {
+		if len(conns) == maxMetadataPeers {
+			break
+		}
+
+		peer, err := ExtendedHandShakeWithPeer(t, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if peer.Extensions == nil {
+			peer.Close()
+			lastErr = fmt.Errorf("peer %s does not support extensions", addr)
+			continue
+		}
+
+		peerSize := peer.Extensions.MetadataSize
+		if _, ok := peer.Extensions.ExtensionID(utMetadata); !ok || peerSize <= 0 || peerSize > maxMetadataSize {
+			peer.Close()
+			lastErr = fmt.Errorf("peer %s does not provide metadata", addr)
+			continue
+		}
+
+		if size == 0 {
+			size = peerSize
+		} else if peerSize != size {
+			peer.Close()
+			continue
+		}
+		conns = append(conns, peer)
+	}
+
+	if len(conns) == 0 {
+		return nil, 0, lastErr
+	}
+	return conns, size, nil
+}
+
+// requestMetadataPiece requests one piece of the metadata from a peer and
+// waits for it, skipping unrelated messages.
+//
+// Parameters:
+// - peer: A pointer to a PeerConn whose peer supports the metadata extension.
+// - index: The index of the metadata piece.
+// - size: The total size of the metadata.
+//
+// Returns:
+// - A byte slice containing the piece.
+// - An error if the peer rejects the request, sends a malformed piece or does not answer in time.
+func requestMetadataPiece(peer *PeerConn, index int, size int64) ([]byte, error) {
+	extID, _ := peer.Extensions.ExtensionID(utMetadata)
+	request, err := Marshal(metadataMessage{MsgType: metadataRequest, Piece: int64(index)})
+	if err != nil {
+		return nil, err
+	}
+
+	peer.deadline = time.Now().Add(metadataReqTimeout)
+	defer func() { peer.deadline = time.Time{} }()
+	if err := peer.SetWriteDeadline(peer.deadline); err != nil {
+		return nil, err
+	}
+	defer peer.SetWriteDeadline(time.Time{})
+
+	if err := sendExtended(peer, extID, request); err != nil {
+		return nil, err
+	}
+
+	for {
+		msgId, payload, err := peer.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		if msgId != MsgExtended || len(payload) == 0 || payload[0] != utMetadataID {
+			continue
+		}
+
+		decoder := NewDecoder(bytes.NewReader(payload[1:]))
+		decoder.SetLimits(peerMessageLimits)
+		var msg metadataMessage
+		if err := decoder.DecodeInto(&msg); err != nil {
+			return nil, err
+		}
+
+		if msg.Piece != int64(index) {
+			continue
+		}
+
+		switch msg.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", index)
+		case metadataData:
+			piece := payload[1+decoder.InputOffset():]
+			want := min(metadataPieceSize, size-int64(index)*metadataPieceSize)
+			if int64(len(piece)) != want {
+				return nil, fmt.Errorf("expected %d bytes of metadata piece %d but got %d", want, index, len(piece))
+			}
+			return piece, nil
+		}
+	}
+}
+
+// answerMetadataRequest answers a ut_metadata request from the peer with the
+// requested piece of p.Metadata, or with a reject if we do not have the
+// metadata or the piece does not exist. It reports whether the message was a
+// request; data and reject messages are left to the caller.
+func (p *PeerConn) answerMetadataRequest(payload []byte) (bool, error) {
+	decoder := NewDecoder(bytes.NewReader(payload))
+	decoder.SetLimits(peerMessageLimits)
+	var msg metadataMessage
+	if err := decoder.DecodeInto(&msg); err != nil || msg.MsgType != metadataRequest {
+		return false, nil
+	}
+
+	if p.Extensions == nil {
+		return true, nil
+	}
+	extID, ok := p.Extensions.ExtensionID(utMetadata)
+	if !ok {
+		return true, nil
+	}
+
+	size := int64(len(p.Metadata))
+	if msg.Piece < 0 || msg.Piece*metadataPieceSize >= size {
+		reject, err := Marshal(metadataMessage{MsgType: metadataReject, Piece: msg.Piece})
+		if err != nil {
+			return true, err
+		}
+		return true, sendExtended(p, extID, reject)
+	}
+
+	header, err := Marshal(metadataMessage{MsgType: metadataData, Piece: msg.Piece, TotalSize: size})
+	if err != nil {
+		return true, err
+	}
+	return true, sendExtended(p, extID, append(header, metadataPiece(p.Metadata, int(msg.Piece))...))
+}
+
+// verifyMetadata checks an info dictionary against the torrent's info hash,
+// or its v2 info hash if it only has that.
+func verifyMetadata(t TorrentInfo, metadata []byte) error {
+	if t.InfoHash != "" {
+		if calculateInfoHash(metadata) != t.InfoHash {
+			return fmt.Errorf("metadata does not match info hash %s", t.InfoHash)
+		}
+		return nil
+	}
+
+	hash := sha256.Sum256(metadata)
+	if hex.EncodeToString(hash[:]) != t.InfoHashV2 {
+		return fmt.Errorf("metadata does not match info hash %s", t.InfoHashV2)
+	}
+	return nil
+}
+
+// WriteTorrent writes t as a .torrent file: its info dictionary exactly as
+// received, along with its trackers, web seeds and descriptive fields.
+//
+// Parameters:
+// - t: A TorrentInfo struct with the raw info dictionary set.
+// - w: The writer the bencoded metainfo is written to.
+//
+// Returns:
+// - An error if the torrent has no info dictionary or the metainfo cannot be written.
+func WriteTorrent(t TorrentInfo, w io.Writer) error {
+	if len(t.RawInfo) == 0 {
+		return fmt.Errorf("missing info dictionary")
+	}
+
+	meta := metainfoFile{
+		Announce:     t.Announce,
+		AnnounceList: t.AnnounceList,
+		Comment:      t.Comment,
+		CreatedBy:    t.CreatedBy,
+		Info:         t.RawInfo,
+		URLList:      t.URLList,
+	}
+	if !t.CreationDate.IsZero() {
+		meta.CreationDate = t.CreationDate.Unix()
+	}
+
+	return NewEncoder(w).Encode(meta)
+}
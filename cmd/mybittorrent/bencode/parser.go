@@ -1,21 +1,39 @@
 package bencode
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
 )
 
 type Parser struct {
-	decoder *Decoder
-	encoder *Encoder
+	decoder       *Decoder
+	withoutLayers bool // accept hybrid torrents without their piece layers
 }
 
-func CreateParser(input string) *Parser {
-	return &Parser{
-		decoder: NewDecoder(input),
-		encoder: &Encoder{},
-	}
+// CreateParser creates a Parser that reads bencoded data from r.
+// The raw bytes of the info dictionary are recorded while parsing so that the
+// info hash can be computed over exactly what the torrent file contains.
+func CreateParser(r io.Reader) *Parser {
+	decoder := NewDecoder(r)
+	decoder.RecordRaw("info")
+	return &Parser{decoder: decoder}
+}
+
+// SetWithoutPieceLayers enables or disables parsing torrents built from an
+// info dictionary alone, such as one fetched from peers for a magnet link
+// (BEP 9). Piece layers live outside the info dictionary, so in this mode a
+// hybrid torrent missing them is accepted, and its pieces are verified
+// against their v1 hashes only. A v2-only torrent has no other hashes to fall
+// back on and still needs its piece layers.
+func (p *Parser) SetWithoutPieceLayers(enabled bool) {
+	p.withoutLayers = enabled
 }
 
 func (p *Parser) Parse() (interface{}, error) {
@@ -43,72 +61,447 @@ func (p *Parser) ParseTorrent() (*TorrentInfo, error) {
 		return nil, fmt.Errorf("missing info dictionary")
 	}
 
-	announce, ok := dict["announce"].(string)
+	announce, _ := dict["announce"].([]byte)
+	announceList := parseAnnounceList(dict["announce-list"])
+	// Trackerless torrents, such as those resolved from a magnet link without
+	// trackers, leave Announce empty and find their peers by other means.
+	if len(announce) == 0 && len(announceList) > 0 {
+		announce = []byte(announceList[0][0])
+	}
+
+	name := utf8Variant(info, "name")
+	pieceLength, ok := info["piece length"].(int64)
+	if !ok || pieceLength <= 0 {
+		return nil, fmt.Errorf("missing piece length")
+	}
+
+	rawInfo, ok := p.decoder.RawSpan("info")
 	if !ok {
-		return nil, fmt.Errorf("missing announce URL")
+		return nil, fmt.Errorf("missing info dictionary")
+	}
+
+	metaVersion := 1
+	var v2Files []File
+	var pieceLayers map[string][]byte
+	if version, ok := info["meta version"].(int64); ok && version == 2 {
+		metaVersion = 2
+		_, hybrid := info["pieces"].([]byte)
+		v2Files, pieceLayers, err = parseV2Files(info, dict["piece layers"], pieceLength, p.withoutLayers && hybrid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var files []File
+	var piecesHashes []string
+	if pieces, ok := info["pieces"].([]byte); ok {
+		files, err = parseFiles(info, name)
+		if err != nil {
+			return nil, err
+		}
+
+		piecesHashes, err = extractPieceHashes(pieces)
+		if err != nil {
+			return nil, err
+		}
+
+		length := totalLength(files)
+		if pieceCnt := (length + pieceLength - 1) / pieceLength; int64(len(piecesHashes)) != pieceCnt {
+			return nil, fmt.Errorf("expected %d piece hashes for %d bytes but got %d", pieceCnt, length, len(piecesHashes))
+		}
+
+		if metaVersion == 2 {
+			attachPiecesRoots(files, v2Files)
+		}
+	} else if metaVersion == 2 {
+		files = v2Files
+	} else {
+		return nil, fmt.Errorf("missing pieces")
+	}
+
+	torrentInfo := &TorrentInfo{
+		Announce:     string(announce),
+		AnnounceList: announceList,
+		Comment:      utf8Variant(dict, "comment"),
+		CreatedBy:    utf8Variant(dict, "created by"),
+		URLList:      stringList(dict["url-list"]),
+		HTTPSeeds:    stringList(dict["httpseeds"]),
+		Name:         name,
+		Files:        files,
+		Length:       totalLength(files),
+		Private:      info["private"] == int64(1),
+		Info:         info,
+		RawInfo:      rawInfo.Bytes,
+		MetaVersion:  metaVersion,
+		PieceLength:  pieceLength,
+		PieceHashes:  piecesHashes,
+		PieceLayers:  pieceLayers,
+		Extra:        unknownKeys(dict),
+	}
+
+	if len(piecesHashes) > 0 {
+		torrentInfo.InfoHash = calculateInfoHash(rawInfo.Bytes)
+	}
+	if metaVersion == 2 {
+		torrentInfo.InfoHashV2 = calculateInfoHashV2(rawInfo.Bytes)
+	}
+
+	if creationDate, ok := dict["creation date"].(int64); ok {
+		torrentInfo.CreationDate = time.Unix(creationDate, 0).UTC()
+	}
+
+	return torrentInfo, nil
+}
+
+// knownKeys are the top-level metainfo keys parsed into TorrentInfo fields.
+var knownKeys = map[string]bool{
+	"announce":         true,
+	"announce-list":    true,
+	"comment":          true,
+	"comment.utf-8":    true,
+	"created by":       true,
+	"created by.utf-8": true,
+	"creation date":    true,
+	"httpseeds":        true,
+	"info":             true,
+	"piece layers":     true,
+	"url-list":         true,
+}
+
+// unknownKeys returns the top-level metainfo entries that have no TorrentInfo
+// field, so that they are not lost, or nil if there are none.
+func unknownKeys(dict map[string]interface{}) map[string]interface{} {
+	var extra map[string]interface{}
+	for key, value := range dict {
+		if knownKeys[key] {
+			continue
+		}
+
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[key] = value
+	}
+	return extra
+}
+
+// parseAnnounceList extracts the tracker tiers of BEP 12 from an announce-list
+// value. Malformed entries and empty tiers are skipped.
+//
+// Parameters:
+// - value: The value stored under the "announce-list" key, if any.
+//
+// Returns:
+// - A slice of tiers, each a slice of tracker URLs, or nil if there are none.
+func parseAnnounceList(value interface{}) [][]string {
+	tiers, _ := value.([]interface{})
+
+	var announceList [][]string
+	for _, tier := range tiers {
+		if urls := stringList(tier); len(urls) > 0 {
+			announceList = append(announceList, urls)
+		}
+	}
+	return announceList
+}
+
+// stringList converts a bencoded list of byte strings to a slice of strings.
+// A lone byte string, as some torrents use for "url-list", yields a slice of
+// one; anything else that is not a byte string is skipped.
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case []byte:
+		if len(v) == 0 {
+			return nil
+		}
+		return []string{string(v)}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.([]byte); ok && len(s) > 0 {
+				list = append(list, string(s))
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// parseFiles extracts the files of a torrent from its info dictionary.
+// A single-file torrent has a "length" key and yields one file named after the
+// torrent; a multi-file torrent has a "files" list whose entries carry a
+// "length" and a "path" list of components relative to the torrent's root.
+//
+// Parameters:
+// - info: A map[string]interface{} representing the info dictionary.
+// - name: The suggested name of the file or root directory.
+//
+// Returns:
+// - A slice of File structs in the order the files appear in the torrent's data.
+// - An error if neither form is present or a file entry is malformed.
+func parseFiles(info map[string]interface{}, name string) ([]File, error) {
+	if length, ok := info["length"].(int64); ok {
+		if length < 0 {
+			return nil, fmt.Errorf("invalid length %d", length)
+		}
+		return []File{{Path: []string{name}, Length: length}}, nil
 	}
 
-	length, ok := info["length"].(int)
+	list, ok := info["files"].([]interface{})
 	if !ok {
 		return nil, fmt.Errorf("missing length")
 	}
 
-	pieceLength, ok := info["piece length"].(int)
-	if !ok {
-		return nil, fmt.Errorf("missing piece length")
+	if err := validatePathComponent(name); err != nil {
+		return nil, fmt.Errorf("invalid name: %w", err)
 	}
 
-	pieces, ok := info["pieces"].(string)
-	if !ok {
-		return nil, fmt.Errorf("missing pieces")
+	files := make([]File, 0, len(list))
+	var offset int64
+	for i, entry := range list {
+		fileDict, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file %d: %w", i, InvalidFormat(TypeDict))
+		}
+
+		length, ok := fileDict["length"].(int64)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file %d: missing length", i)
+		}
+
+		pathKey := "path"
+		if _, ok := fileDict["path.utf-8"].([]interface{}); ok {
+			pathKey = "path.utf-8"
+		}
+
+		components, ok := fileDict[pathKey].([]interface{})
+		if !ok || len(components) == 0 {
+			return nil, fmt.Errorf("file %d: missing path", i)
+		}
+
+		path := make([]string, len(components))
+		for j, component := range components {
+			c, ok := component.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("file %d: %w", i, InvalidFormat(TypeString))
+			}
+
+			if err := validatePathComponent(string(c)); err != nil {
+				return nil, fmt.Errorf("file %d: %w", i, err)
+			}
+			path[j] = string(c)
+		}
+
+		attr, _ := fileDict["attr"].([]byte)
+		files = append(files, File{
+			Path:    path,
+			Length:  length,
+			Offset:  offset,
+			Padding: bytes.IndexByte(attr, 'p') >= 0,
+		})
+		offset += length
 	}
-	hash, err := calculateInfoHash(p, info)
-	piecesHashes, err := extractPieceHashes(pieces)
 
-	if err != nil {
-		return nil, err
+	return files, nil
+}
+
+// validatePathComponent rejects path components that could place a file
+// outside of the torrent's root directory.
+func validatePathComponent(component string) error {
+	if component == "" || component == "." || component == ".." || strings.ContainsAny(component, "/\\\x00") {
+		return fmt.Errorf("unsafe path component %q", component)
+	}
+	return nil
+}
+
+// utf8Variant returns the string stored under key in dict, preferring the
+// "<key>.utf-8" variant some clients add when the original is not UTF-8.
+func utf8Variant(dict map[string]interface{}, key string) string {
+	if value, ok := dict[key+".utf-8"].([]byte); ok {
+		return string(value)
 	}
 
-	return &TorrentInfo{
-		Announce:    announce,
-		Length:      int64(length),
-		Info:        info,
-		InfoHash:    hash,
-		PieceLength: int64(pieceLength),
-		PieceHashes: piecesHashes,
-	}, nil
+	value, _ := dict[key].([]byte)
+	return string(value)
 }
 
-// calculateInfoHash calculates the SHA-1 hash of the encoded info dictionary.
-// The info dictionary is first encoded into a bencoded string, and then the SHA-1 hash is computed.
+// totalLength returns the sum of the lengths of files.
+func totalLength(files []File) int64 {
+	var length int64
+	for _, file := range files {
+		length += file.Length
+	}
+	return length
+}
+
+// parseV2Files extracts the files of a v2 torrent (BEP 52) from the "file tree"
+// of its info dictionary, and the piece layers of those files from the
+// top-level "piece layers" dictionary. Every file starts on a piece boundary,
+// so file offsets account for the unused remainder of each file's last piece.
 //
 // Parameters:
-// - parser: A pointer to the Parser instance containing the encoder.
-// - info: A map[string]interface{} representing the info dictionary to be hashed.
+// - info: A map[string]interface{} representing the info dictionary.
+// - layers: The value stored under the top-level "piece layers" key, if any.
+// - pieceLength: The piece length of the torrent.
+// - allowMissing: Whether files may lack a piece layer, which is then left out of the result.
 //
 // Returns:
-// - A string containing the hexadecimal representation of the SHA-1 hash.
-// - An error if the encoding of the info dictionary fails.
-func calculateInfoHash(parser *Parser, info map[string]interface{}) (string, error) {
-	encoded, err := parser.encoder.encodeDict(info)
-	if err != nil {
-		return "", err
+// - A slice of File structs in file tree order.
+// - The piece layers, keyed by the pieces root of their file.
+// - An error if the file tree is malformed or a piece layer is missing or does not match its root.
+func parseV2Files(info map[string]interface{}, layers interface{}, pieceLength int64, allowMissing bool) ([]File, map[string][]byte, error) {
+	if pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, nil, fmt.Errorf("invalid v2 piece length %d", pieceLength)
+	}
+
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("missing file tree")
+	}
+
+	var files []File
+	if err := walkFileTree(tree, nil, &files); err != nil {
+		return nil, nil, err
+	}
+
+	layerDict, _ := layers.(map[string]interface{})
+	pieceLayers := make(map[string][]byte)
+	var offset int64
+	for i := range files {
+		file := &files[i]
+		file.Offset = offset
+		offset += (file.Length + pieceLength - 1) / pieceLength * pieceLength
+
+		if file.Length <= pieceLength {
+			continue
+		}
+
+		layer, ok := layerDict[string(file.PiecesRoot)].([]byte)
+		if !ok && allowMissing {
+			continue
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("%w for %s", ErrMissingPieceLayer, strings.Join(file.Path, "/"))
+		}
+
+		if err := verifyPieceLayer(layer, file.PiecesRoot, file.Length, pieceLength); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", strings.Join(file.Path, "/"), err)
+		}
+		pieceLayers[string(file.PiecesRoot)] = layer
 	}
 
-	hash := sha1.Sum([]byte(encoded))
-	return hex.EncodeToString(hash[:]), nil
+	return files, pieceLayers, nil
+}
+
+// walkFileTree appends the files below a node of a v2 file tree to files, in
+// key order. A file is a dictionary with a single empty key holding its
+// "length" and, unless it is empty, its "pieces root".
+func walkFileTree(node map[string]interface{}, path []string, files *[]File) error {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("file tree: %w", InvalidFormat(TypeDict))
+		}
+
+		if name == "" {
+			if len(path) == 0 {
+				return fmt.Errorf("file tree: file without a name")
+			}
+
+			length, ok := child["length"].(int64)
+			if !ok || length < 0 {
+				return fmt.Errorf("file tree: missing length for %s", strings.Join(path, "/"))
+			}
+
+			file := File{Path: append([]string(nil), path...), Length: length}
+			if length > 0 {
+				root, ok := child["pieces root"].([]byte)
+				if !ok || len(root) != sha256.Size {
+					return fmt.Errorf("file tree: missing pieces root for %s", strings.Join(path, "/"))
+				}
+				file.PiecesRoot = root
+			}
+
+			*files = append(*files, file)
+			continue
+		}
+
+		if err := validatePathComponent(name); err != nil {
+			return fmt.Errorf("file tree: %w", err)
+		}
+
+		if err := walkFileTree(child, append(path, name), files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachPiecesRoots copies the pieces roots of a hybrid torrent's v2 file tree
+// onto the matching files of its v1 file list.
+func attachPiecesRoots(files, v2Files []File) {
+	roots := make(map[string][]byte, len(v2Files))
+	for _, file := range v2Files {
+		roots[strings.Join(file.Path, "/")] = file.PiecesRoot
+	}
+
+	for i := range files {
+		if files[i].Padding {
+			continue
+		}
+
+		root, ok := roots[strings.Join(files[i].Path, "/")]
+		if !ok {
+			continue
+		}
+		files[i].PiecesRoot = root
+	}
+}
+
+// calculateInfoHashV2 calculates the SHA-256 hash of the info dictionary of a
+// v2 torrent (BEP 52), taken over its raw bytes like calculateInfoHash.
+//
+// Parameters:
+// - rawInfo: A byte slice containing the bencoded info dictionary.
+//
+// Returns:
+// - A string containing the hexadecimal representation of the SHA-256 hash.
+func calculateInfoHashV2(rawInfo []byte) string {
+	hash := sha256.Sum256(rawInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+// calculateInfoHash calculates the SHA-1 hash of the info dictionary.
+// The hash is taken over the raw bytes of the dictionary as they appear in the
+// torrent file; re-encoding the decoded value would not reproduce them for
+// torrents that are not in canonical form.
+//
+// Parameters:
+// - rawInfo: A byte slice containing the bencoded info dictionary.
+//
+// Returns:
+// - A string containing the hexadecimal representation of the SHA-1 hash.
+func calculateInfoHash(rawInfo []byte) string {
+	hash := sha1.Sum(rawInfo)
+	return hex.EncodeToString(hash[:])
 }
 
-// extractPieceHashes extracts SHA-1 hash pieces from a given string.
-// The pieces string is expected to be a concatenation of 20-byte SHA-1 hashes.
+// extractPieceHashes extracts SHA-1 hash pieces from the given bytes.
+// The pieces value is expected to be a concatenation of 20-byte SHA-1 hashes.
 //
 // Parameters:
-// - pieces: A string containing the concatenated SHA-1 hashes.
+// - pieces: A byte slice containing the concatenated SHA-1 hashes.
 //
 // Returns:
 // - A slice of strings, each representing a hexadecimal-encoded SHA-1 hash.
-// - An error if the length of the pieces string is not a multiple of 20.
-func extractPieceHashes(pieces string) ([]string, error) {
+// - An error if the length of pieces is not a multiple of 20.
+func extractPieceHashes(pieces []byte) ([]string, error) {
 	hashLength := 20
 	if len(pieces)%hashLength != 0 {
 		return nil, fmt.Errorf("invalid pieces length")
@@ -117,7 +510,7 @@ func extractPieceHashes(pieces string) ([]string, error) {
 	var hashes []string
 	for i := 0; i < len(pieces); i += hashLength {
 		hash := pieces[i : i+hashLength]
-		hashes = append(hashes, hex.EncodeToString([]byte(hash)))
+		hashes = append(hashes, hex.EncodeToString(hash))
 	}
 
 	return hashes, nil
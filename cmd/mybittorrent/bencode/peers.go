@@ -1,59 +1,98 @@
 package bencode
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/sha1"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 )
 
-// CallTracker sends a request to the tracker URL specified in the TorrentInfo and returns the response.
+// CallTracker sends a request to the tracker URL specified in the TorrentInfo and returns the parsed response.
+// The torrent is announced under its preferred info hash; see FindPeers for
+// announcing to every tracker tier and under both info hashes of a hybrid torrent.
+// HTTP trackers are called through DefaultHTTPTracker.
 //
 // Parameters:
 // - t: A TorrentInfo struct containing the torrent metadata.
 //
 // Returns:
-// - A byte slice containing the response from the tracker.
-// - An error if any step in the process fails.
-func CallTracker(t TorrentInfo) ([]byte, error) {
-	infoHash, err := hex.DecodeString(t.InfoHash)
+// - A pointer to the TrackerResponse.
+// - A *TrackerFailure if the tracker refused the announce, or an error if any other step fails.
+func CallTracker(t TorrentInfo) (*TrackerResponse, error) {
+	infoHashes, err := t.InfoHashes()
 	if err != nil {
 		return nil, err
 	}
 
-	peerId := make([]byte, 20)
-	if _, err := rand.Read(peerId); err != nil {
-		return nil, err
+	return announceTo(context.Background(), DefaultHTTPTracker, t.Announce, newAnnounceRequest(t, infoHashes[0], EventNone, nil))
+}
+
+// FindPeers announces the torrent to its trackers, walking the tiers of its
+// announce list (BEP 12), and returns every peer reported, without
+// duplicates. A hybrid torrent is announced under each of its info hashes,
+// since its v1 and v2 swarms are tracked separately.
+//
+// Parameters:
+// - t: A TorrentInfo struct containing the torrent metadata.
+//
+// Returns:
+// - A slice of strings, each representing a peer in the format "IP:port".
+// - An error if no announce succeeds.
+func FindPeers(t TorrentInfo) ([]string, error) {
+	return NewTrackerManager(t).Announce(EventNone)
+}
+
+// newAnnounceRequest builds the announce request of a torrent for one of its
+// info hashes, with the identity of the current session and the bytes
+// transferred so far. Without stats, nothing has been transferred yet.
+func newAnnounceRequest(t TorrentInfo, infoHash []byte, event TrackerEvent, stats *TransferStats) AnnounceRequest {
+	if stats == nil {
+		stats = NewTransferStats(torrentLeft(t))
 	}
-	params := url.Values{
-		"info_hash":  {string(infoHash)},
-		"peer_id":    {string(peerId)},
-		"port":       {"6881"},
-		"uploaded":   {"0"},
-		"downloaded": {"0"},
-		"left":       {fmt.Sprintf("%d", t.Length)},
-		"compact":    {"1"},
+
+	// Binding the listener settles the port peers can reach us on.
+	sess := CurrentSession()
+	sess.Listener()
+	req := AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   sess.PeerID,
+		Port:     sess.Port,
+		Event:    event,
+		NumWant:  sess.NumWant,
+		Key:      sess.Key,
+		IP:       sess.IP,
+		IPv6:     sess.IPv6,
 	}
+	req.Uploaded, req.Downloaded, req.Left = stats.Snapshot()
 
-	reqUrl := fmt.Sprintf("%s?%s", t.Announce, params.Encode())
-	resp, err := http.Get(reqUrl)
+	// Peers are of no use once we leave the swarm.
+	if event == EventStopped {
+		req.NumWant = 0
+	}
+	return req
+}
 
+// announceTo sends an announce request to a tracker, over HTTP through h or
+// over UDP (BEP 15) depending on the scheme of its URL.
+func announceTo(ctx context.Context, h *HTTPTracker, tracker string, req AnnounceRequest) (*TrackerResponse, error) {
+	u, err := url.Parse(tracker)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid announce URL %q: %w", tracker, err)
 	}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-
-		}
-	}(resp.Body)
-
-	return io.ReadAll(resp.Body)
+	switch u.Scheme {
+	case "http", "https":
+		return h.Announce(ctx, tracker, req)
+	case "udp":
+		return udpTrackerFor(u).Announce(ctx, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker URL %q", tracker)
+	}
 }
 
 // ExtractPeers extracts peer information from the tracker response.
@@ -63,37 +102,78 @@ func CallTracker(t TorrentInfo) ([]byte, error) {
 //
 // Returns:
 // - A slice of strings, each representing a peer in the format "IP:port".
-// - An error if the decoding fails or if the "peers" field is missing.
+// - A *TrackerFailure if the tracker refused the announce, or an error if the response is malformed.
 func ExtractPeers(trackerResp []byte) ([]string, error) {
-	decoder := NewDecoder(string(trackerResp))
-	decoded, err := decoder.Decode()
-
+	resp, err := ParseTrackerResponse(trackerResp)
 	if err != nil {
 		return nil, err
 	}
 
-	dict := decoded.(map[string]interface{})
-	peersData, ok := dict["peers"].(string)
-
-	if !ok {
-		return nil, fmt.Errorf("missing peers")
+	peers := make([]string, len(resp.Peers))
+	for i, peer := range resp.Peers {
+		peers[i] = peer.String()
 	}
+	return peers, nil
+}
 
-	var peers []string
-
-	ipSize := 4
-	portSize := 2
-	for i := 0; i < len(peersData); i += ipSize + portSize {
-		ip := net.IP(peersData[i : i+ipSize])
-		portStart := i + ipSize
-		port := binary.BigEndian.Uint16([]byte(peersData[portStart : portStart+portSize]))
-		peers = append(peers, fmt.Sprintf("%s:%d", ip.String(), port))
+// decodeCompactPeers decodes a list of peers in compact form: each peer is
+// an IPv4 or IPv6 address of ipSize bytes followed by a 2-byte port.
+//
+// Parameters:
+// - data: A byte slice containing the concatenated peers.
+// - ipSize: The length of each address, net.IPv4len or net.IPv6len.
+//
+// Returns:
+// - A slice of strings, each representing a peer in the format "IP:port".
+// - An error if the data is not a whole number of peers.
+func decodeCompactPeers(data []byte, ipSize int) ([]string, error) {
+	addrs, err := decodeCompactPeerAddrs(data, ipSize)
+	if err != nil {
+		return nil, err
 	}
 
+	peers := make([]string, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = addr.String()
+	}
 	return peers, nil
 }
 
+// encodeCompactPeers encodes peers in compact form, split into IPv4 and IPv6
+// lists. Addresses that are not an IP and port are left out.
+//
+// Parameters:
+// - addrs: A slice of strings, each representing a peer in the format "IP:port".
+//
+// Returns:
+// - A byte slice containing the IPv4 peers.
+// - A byte slice containing the IPv6 peers.
+func encodeCompactPeers(addrs []string) ([]byte, []byte) {
+	var v4, v6 []byte
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		ip := net.ParseIP(host)
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if ip == nil || err != nil {
+			continue
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = binary.BigEndian.AppendUint16(append(v4, ip4...), uint16(port))
+		} else {
+			v6 = binary.BigEndian.AppendUint16(append(v6, ip.To16()...), uint16(port))
+		}
+	}
+	return v4, v6
+}
+
 // HandShakeWithPeer establishes a TCP connection with a peer and performs a BitTorrent handshake.
+// A hybrid torrent is offered under each of its info hashes in turn, and the
+// handshake succeeds once the peer answers with any of them.
 //
 // Parameters:
 // - t: A TorrentInfo struct containing the torrent metadata.
@@ -104,32 +184,62 @@ func ExtractPeers(trackerResp []byte) ([]string, error) {
 // - A byte slice containing the handshake response from the peer.
 // - An error if any step in the process fails
 func HandShakeWithPeer(t TorrentInfo, peerAddress string) (net.Conn, []byte, error) {
-	conn, err := connectToPeer(peerAddress, t)
+	infoHashes, err := t.InfoHashes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, infoHash := range infoHashes {
+		var conn net.Conn
+		var response []byte
+		conn, response, err = handShakeFor(peerAddress, t, infoHash)
+		if err == nil {
+			return conn, response, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// handShakeFor connects to a peer and performs a handshake for infoHash, and
+// checks that the peer answers with one of the torrent's info hashes.
+func handShakeFor(addr string, t TorrentInfo, infoHash []byte) (net.Conn, []byte, error) {
+	conn, err := connectToPeer(addr, t, infoHash)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	response := make([]byte, 68)
-	if _, err := conn.Read(response); err != nil {
+	if err := conn.SetReadDeadline(time.Now().Add(peerReadTimeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(conn, response); err != nil {
+		conn.Close()
 		return nil, nil, err
 	}
+	conn.SetReadDeadline(time.Time{})
+
+	if !t.hasInfoHash(response[28:48]) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("peer %s answered with unknown info hash %x", addr, response[28:48])
+	}
 
 	return conn, response, nil
 }
 
-func connectToPeer(addr string, t TorrentInfo) (net.Conn, error) {
-	conn, err := net.Dial("tcp", addr)
+func connectToPeer(addr string, t TorrentInfo, infoHash []byte) (net.Conn, error) {
+	message, err := createHandShakeMessage(infoHash, string(CurrentSession().PeerID), t.MetaVersion == 2)
 	if err != nil {
 		return nil, err
 	}
 
-	infoHashBytes, err := hex.DecodeString(t.InfoHash)
+	conn, err := net.DialTimeout("tcp", addr, peerDialTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	message := createHandShakeMessage(infoHashBytes, "00112233445566778899")
 	if _, err := conn.Write(message); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -137,22 +247,40 @@ func connectToPeer(addr string, t TorrentInfo) (net.Conn, error) {
 }
 
 // createHandShakeMessage creates a BitTorrent handshake message.
+// The info hash is either the SHA-1 info hash of the torrent or its SHA-256
+// info hash truncated to 20 bytes. The reserved bytes always advertise support
+// for the extension protocol (BEP 10).
 //
 // Parameters:
-// - infoHash: A byte slice containing the info hash of the torrent.
+// - infoHash: A byte slice containing the 20-byte info hash of the torrent.
 // - peerId: A string containing the peer ID.
+// - v2: Whether to advertise support for BitTorrent v2 (BEP 52) in the reserved bytes.
 //
 // Returns:
 // - A byte slice representing the handshake message.
-func createHandShakeMessage(infoHash []byte, peerId string) []byte {
+// - An error if the info hash or peer ID is not 20 bytes long.
+func createHandShakeMessage(infoHash []byte, peerId string, v2 bool) ([]byte, error) {
+	if len(infoHash) != sha1.Size {
+		return nil, fmt.Errorf("invalid info hash length %d", len(infoHash))
+	}
+	if len(peerId) != 20 {
+		return nil, fmt.Errorf("invalid peer id length %d", len(peerId))
+	}
+
 	protocolString := "BitTorrent protocol"
 	handShake := make([]byte, 0, 68)
 
+	reserved := make([]byte, 8)
+	reserved[5] |= extensionBit
+	if v2 {
+		reserved[7] |= 0x10
+	}
+
 	handShake = append(handShake, byte(len(protocolString)))
 	handShake = append(handShake, []byte(protocolString)...)
-	handShake = append(handShake, make([]byte, 8)...) // 8 reserved bytes (0x00)
+	handShake = append(handShake, reserved...)
 	handShake = append(handShake, infoHash...)
 	handShake = append(handShake, []byte(peerId)...)
 
-	return handShake
+	return handShake, nil
 }
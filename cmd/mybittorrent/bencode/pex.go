@@ -0,0 +1,335 @@
+package bencode
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	utPex         = "ut_pex"
+	utPexID       = 2           // extended message id peers send ut_pex messages to us under
+	maxPexPeers   = 50          // peers listed in the added or dropped list of one message
+	maxPoolDrops  = 50          // dropped peers remembered for the next message
+	maxPoolQueue  = 1000        // peers waiting to be tried; more are ignored
+	maxPoolKnown  = 10000       // peers remembered as known before tried ones are forgotten
+	pexInterval   = time.Minute // time between ut_pex messages to a peer
+	compactV4Size = net.IPv4len + 2
+	compactV6Size = net.IPv6len + 2
+)
+
+// Flags describing an added peer in a ut_pex message (BEP 11).
+const (
+	PexEncryption = 0x01 // peer prefers encrypted connections
+	PexSeed       = 0x02 // peer is a seed or upload only
+	PexUTP        = 0x04 // peer supports uTP
+	PexHolepunch  = 0x08 // peer supports the holepunch extension
+	PexOutgoing   = 0x10 // connection to the peer was outgoing, so it is reachable
+)
+
+func init() {
+	localExtensions[utPex] = utPexID
+}
+
+// pexMessage is the payload of a ut_pex message. Peers are listed in compact
+// form; each byte of a flags string describes the peer at the same position
+// in the matching list.
+type pexMessage struct {
+	Added    []byte `bencode:"added,omitempty"`
+	AddedF   []byte `bencode:"added.f,omitempty"`
+	Added6   []byte `bencode:"added6,omitempty"`
+	Added6F  []byte `bencode:"added6.f,omitempty"`
+	Dropped  []byte `bencode:"dropped,omitempty"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// PexPeer is a peer learned through peer exchange.
+type PexPeer struct {
+	Addr  string // in the format "IP:port"
+	Flags byte   // combination of the Pex* flags
+}
+
+// parsePex decodes a ut_pex message into the peers it adds and drops.
+// Malformed lists are ignored rather than failing the connection, and only
+// the first maxPexPeers peers of each list are read.
+func parsePex(payload []byte) ([]PexPeer, []string, error) {
+	var msg pexMessage
+	decoder := NewDecoder(bytes.NewReader(payload))
+	decoder.SetLimits(peerMessageLimits)
+	if err := decoder.DecodeInto(&msg); err != nil {
+		return nil, nil, err
+	}
+
+	var added []PexPeer
+	for _, list := range []struct {
+		peers, flags []byte
+		ipSize       int
+	}{
+		{msg.Added, msg.AddedF, net.IPv4len},
+		{msg.Added6, msg.Added6F, net.IPv6len},
+	} {
+		addrs, err := decodeCompactPeers(firstPexPeers(list.peers, list.ipSize), list.ipSize)
+		if err != nil {
+			continue
+		}
+
+		for i, addr := range addrs {
+			peer := PexPeer{Addr: addr}
+			if i < len(list.flags) {
+				peer.Flags = list.flags[i]
+			}
+			added = append(added, peer)
+		}
+	}
+
+	var dropped []string
+	if addrs, err := decodeCompactPeers(firstPexPeers(msg.Dropped, net.IPv4len), net.IPv4len); err == nil {
+		dropped = append(dropped, addrs...)
+	}
+	if addrs, err := decodeCompactPeers(firstPexPeers(msg.Dropped6, net.IPv6len), net.IPv6len); err == nil {
+		dropped = append(dropped, addrs...)
+	}
+	return added, dropped, nil
+}
+
+// firstPexPeers cuts a compact peer list down to its first maxPexPeers peers.
+// A list that is not a whole number of peers is left as is, to be rejected.
+func firstPexPeers(peers []byte, ipSize int) []byte {
+	if len(peers)%(ipSize+2) != 0 {
+		return peers
+	}
+	return peers[:min(len(peers), maxPexPeers*(ipSize+2))]
+}
+
+// encodePex builds a ut_pex message adding and dropping the given peers, at
+// most maxPexPeers of each. Every added peer is flagged as reachable.
+func encodePex(added, dropped []string) ([]byte, error) {
+	var msg pexMessage
+	msg.Added, msg.Added6 = encodeCompactPeers(added[:min(len(added), maxPexPeers)])
+	msg.AddedF = bytes.Repeat([]byte{PexOutgoing}, len(msg.Added)/compactV4Size)
+	msg.Added6F = bytes.Repeat([]byte{PexOutgoing}, len(msg.Added6)/compactV6Size)
+	msg.Dropped, msg.Dropped6 = encodeCompactPeers(dropped[:min(len(dropped), maxPexPeers)])
+	return Marshal(msg)
+}
+
+// SendPex sends a ut_pex message to the peer, if it supports peer exchange
+// and the torrent is not private.
+//
+// Parameters:
+// - added: The addresses of peers we are connected to, in the format "IP:port".
+// - dropped: The addresses of peers we disconnected from since the last message.
+//
+// Returns:
+// - An error if the message could not be sent.
+func (p *PeerConn) SendPex(added, dropped []string) error {
+	if p.Extensions == nil || p.Private {
+		return nil
+	}
+
+	extID, ok := p.Extensions.ExtensionID(utPex)
+	if !ok || len(added)+len(dropped) == 0 {
+		return nil
+	}
+
+	payload, err := encodePex(added, dropped)
+	if err != nil {
+		return err
+	}
+	return sendExtended(p, extID, payload)
+}
+
+// sendPexUpdate sends the peer a ut_pex message with the peers connected and
+// dropped since the last one, at most once every pexInterval. The first
+// message lists every connected peer and the recently dropped ones.
+func (p *PeerConn) sendPexUpdate() error {
+	if p.Pool == nil || time.Since(p.pexSentAt) < pexInterval {
+		return nil
+	}
+
+	connected, recentlyDropped := p.Pool.pexLists(p.Addr)
+	current := make(map[string]bool)
+	var added, dropped []string
+	for _, addr := range connected {
+		if p.pexSent[addr] {
+			current[addr] = true
+		} else if len(added) < maxPexPeers {
+			current[addr] = true
+			added = append(added, addr)
+		}
+	}
+
+	if p.pexSent == nil {
+		dropped = recentlyDropped
+	}
+	for addr := range p.pexSent {
+		if !current[addr] {
+			dropped = append(dropped, addr)
+		}
+	}
+
+	// Until there is something to tell, the next update may go out at once.
+	if len(added)+len(dropped) == 0 {
+		return nil
+	}
+
+	p.pexSent = current
+	p.pexSentAt = time.Now()
+	return p.SendPex(added, dropped)
+}
+
+// receive reads the next message from the peer. Peer exchange messages and
+// metadata requests are handled here and are not returned: the peers a
+// ut_pex message adds are fed into p.Pool, and ut_metadata requests are
+// answered from p.Metadata.
+func (p *PeerConn) receive() (byte, []byte, error) {
+	for {
+		msgId, payload, err := p.readMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if msgId != MsgExtended || len(payload) == 0 {
+			return msgId, payload, nil
+		}
+
+		switch payload[0] {
+		case utPexID:
+			p.handlePex(payload[1:])
+			continue
+		case utMetadataID:
+			handled, err := p.answerMetadataRequest(payload[1:])
+			if err != nil {
+				return 0, nil, err
+			}
+			if handled {
+				continue
+			}
+		}
+		return msgId, payload, nil
+	}
+}
+
+// handlePex adds the peers of a ut_pex message to p.Pool. Peers of private
+// torrents may only come from the trackers, so the message is ignored then.
+func (p *PeerConn) handlePex(payload []byte) {
+	if p.Private || p.Pool == nil {
+		return
+	}
+
+	added, _, err := parsePex(payload)
+	if err != nil {
+		return
+	}
+
+	for _, peer := range added {
+		p.Pool.Add(peer.Addr)
+	}
+}
+
+// PeerPool holds the peers known for a torrent: those waiting to be tried,
+// those connected and those recently dropped. Peers learned from trackers and
+// from peer exchange are added to the same pool, and each is tried once. It is
+// safe for concurrent use.
+type PeerPool struct {
+	mu        sync.Mutex
+	known     map[string]bool
+	queue     []string
+	connected map[string]bool
+	dropped   []string
+}
+
+// NewPeerPool creates an empty PeerPool.
+func NewPeerPool() *PeerPool {
+	return &PeerPool{known: make(map[string]bool), connected: make(map[string]bool)}
+}
+
+// Add queues the peers not known to the pool yet and returns how many were
+// new. Peers beyond maxPoolQueue waiting to be tried are ignored. Once
+// maxPoolKnown peers are known, the pool forgets the ones already tried, which
+// may then be added again.
+func (p *PeerPool) Add(addrs ...string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if p.known[addr] || len(p.queue) >= maxPoolQueue {
+			continue
+		}
+
+		if len(p.known) >= maxPoolKnown {
+			p.forgetTried()
+		}
+
+		p.known[addr] = true
+		p.queue = append(p.queue, addr)
+		added++
+	}
+	return added
+}
+
+// forgetTried forgets the peers that are neither queued nor connected.
+// p.mu must be held.
+func (p *PeerPool) forgetTried() {
+	p.known = make(map[string]bool, len(p.queue)+len(p.connected))
+	for _, addr := range p.queue {
+		p.known[addr] = true
+	}
+	for addr := range p.connected {
+		p.known[addr] = true
+	}
+}
+
+// Next removes the next peer to try from the queue.
+func (p *PeerPool) Next() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 {
+		return "", false
+	}
+
+	addr := p.queue[0]
+	p.queue = p.queue[1:]
+	return addr, true
+}
+
+// Connected records that a connection to addr was established.
+func (p *PeerPool) Connected(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.connected[addr] = true
+}
+
+// Dropped records that the connection to addr was closed.
+func (p *PeerPool) Dropped(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.connected[addr] {
+		return
+	}
+
+	delete(p.connected, addr)
+	p.dropped = append(p.dropped, addr)
+	if len(p.dropped) > maxPoolDrops {
+		p.dropped = p.dropped[len(p.dropped)-maxPoolDrops:]
+	}
+}
+
+// pexLists returns the peers to announce to the peer at addr in a ut_pex
+// message: every other connected peer, and the recently dropped ones.
+func (p *PeerPool) pexLists(addr string) ([]string, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var added []string
+	for peer := range p.connected {
+		if peer != addr {
+			added = append(added, peer)
+		}
+	}
+	return added, append([]string(nil), p.dropped...)
+}
@@ -0,0 +1,55 @@
+package bencode
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSendPexUpdate(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	pool := NewPeerPool()
+	pool.Add("10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881")
+	for range 3 {
+		addr, _ := pool.Next()
+		pool.Connected(addr)
+	}
+	pool.Dropped("10.0.0.3:6881")
+
+	peer := &PeerConn{
+		Conn:       local,
+		Reader:     bufio.NewReader(local),
+		Addr:       "10.0.0.1:6881",
+		Pool:       pool,
+		Extensions: &ExtensionHandshake{M: map[string]int64{utPex: 3}},
+	}
+	go func() {
+		if err := peer.sendPexUpdate(); err != nil {
+			t.Errorf("sendPexUpdate: %v", err)
+		}
+	}()
+
+	r := &PeerConn{Conn: remote, Reader: bufio.NewReader(remote)}
+	id, payload, err := r.readMessage()
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if id != MsgExtended || len(payload) == 0 || payload[0] != 3 {
+		t.Fatalf("got message %d with payload %q, want a ut_pex message", id, payload)
+	}
+
+	added, dropped, err := parsePex(payload[1:])
+	if err != nil {
+		t.Fatalf("parsePex: %v", err)
+	}
+	if len(added) != 1 || added[0].Addr != "10.0.0.2:6881" {
+		t.Errorf("added = %+v, want 10.0.0.2:6881", added)
+	}
+	if !reflect.DeepEqual(dropped, []string{"10.0.0.3:6881"}) {
+		t.Errorf("dropped = %v, want [10.0.0.3:6881]", dropped)
+	}
+}
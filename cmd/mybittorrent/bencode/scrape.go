@@ -0,0 +1,207 @@
+package bencode
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ScrapeStats is the state of a torrent's swarm as reported by a scrape.
+type ScrapeStats struct {
+	Complete   int64 // seeders
+	Incomplete int64 // leechers
+	Downloaded int64 // completed downloads ever reported
+}
+
+// ScrapeResult is the outcome of scraping one torrent.
+type ScrapeResult struct {
+	ScrapeStats
+	Tracker string // tracker that answered; empty if none did
+	Err     error  // error of the last tracker tried, if none answered
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL,
+// by the convention every tracker that supports scraping follows: the last
+// path component starts with "announce", which is replaced with "scrape".
+//
+// Parameters:
+// - announce: The announce URL of the tracker.
+//
+// Returns:
+// - The scrape URL.
+// - An error if the tracker does not support scraping.
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("invalid announce URL %q: %w", announce, err)
+	}
+
+	slash := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// Scrape asks a tracker for the state of the swarms of several torrents, as
+// ScrapeContext does with a background context.
+//
+// Parameters:
+// - tracker: The announce URL of the tracker.
+// - infoHashes: The 20-byte info hashes of the torrents.
+//
+// Returns:
+// - The stats of each torrent, in the order of infoHashes; torrents the tracker does not know have zero stats.
+// - A *TrackerFailure if the tracker refused the scrape, or an error if any other step fails.
+func Scrape(tracker string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	return ScrapeContext(context.Background(), tracker, infoHashes)
+}
+
+// ScrapeContext asks a tracker for the state of the swarms of several
+// torrents in a single request, over HTTP or UDP (BEP 15) depending on the
+// scheme of its URL. HTTP trackers are asked through DefaultHTTPTracker. A UDP
+// tracker is asked about at most 74 torrents per request, so longer lists take
+// several.
+//
+// Parameters:
+// - ctx: A context that cancels the requests.
+// - tracker: The announce URL of the tracker.
+// - infoHashes: The 20-byte info hashes of the torrents.
+//
+// Returns:
+// - The stats of each torrent, in the order of infoHashes; torrents the tracker does not know have zero stats.
+// - A *TrackerFailure if the tracker refused the scrape, or an error if any other step fails.
+func ScrapeContext(ctx context.Context, tracker string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce URL %q: %w", tracker, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return DefaultHTTPTracker.Scrape(ctx, tracker, infoHashes)
+	case "udp":
+		var stats []ScrapeStats
+		for start := 0; start < len(infoHashes); start += udpMaxScrape {
+			batch, err := udpTrackerFor(u).Scrape(ctx, infoHashes[start:min(start+udpMaxScrape, len(infoHashes))])
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, batch...)
+		}
+		return stats, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker URL %q", tracker)
+	}
+}
+
+// scrapeFile holds the stats of one torrent in an HTTP scrape response.
+type scrapeFile struct {
+	Complete   int64 `bencode:"complete"`
+	Incomplete int64 `bencode:"incomplete"`
+	Downloaded int64 `bencode:"downloaded"`
+}
+
+// scrapeResponse is the response of an HTTP tracker to a scrape, with the
+// stats of each torrent keyed by its raw info hash.
+type scrapeResponse struct {
+	FailureReason string                `bencode:"failure reason,omitempty"`
+	Files         map[string]scrapeFile `bencode:"files"`
+}
+
+// ScrapeTorrents scrapes several torrents, as ScrapeTorrentsContext does with
+// a background context.
+//
+// Parameters:
+// - torrents: The torrents to scrape.
+//
+// Returns:
+// - A slice of ScrapeResult, one per torrent, in the order of torrents.
+func ScrapeTorrents(torrents []TorrentInfo) []ScrapeResult {
+	return ScrapeTorrentsContext(context.Background(), torrents)
+}
+
+// ScrapeTorrentsContext scrapes several torrents, asking each tracker about
+// every torrent it tracks in one request. Each torrent's trackers are tried
+// tier by tier until one answers. Torrents are scraped under their preferred
+// info hash. Once ctx is done, the torrents not scraped yet fail with its
+// error.
+//
+// Parameters:
+// - ctx: A context that cancels the scrapes.
+// - torrents: The torrents to scrape.
+//
+// Returns:
+// - A slice of ScrapeResult, one per torrent, in the order of torrents.
+func ScrapeTorrentsContext(ctx context.Context, torrents []TorrentInfo) []ScrapeResult {
+	results := make([]ScrapeResult, len(torrents))
+	infoHashes := make([][]byte, len(torrents))
+	candidates := make([][]string, len(torrents))
+	for i, t := range torrents {
+		hashes, err := t.InfoHashes()
+		if err != nil || len(hashes) == 0 {
+			results[i].Err = fmt.Errorf("torrent has no info hash")
+			continue
+		}
+		infoHashes[i] = hashes[0]
+
+		for _, st := range NewTrackerManager(t).Status() {
+			candidates[i] = append(candidates[i], st.URL)
+		}
+		if len(candidates[i]) == 0 {
+			results[i].Err = fmt.Errorf("torrent has no trackers")
+		}
+	}
+
+	for {
+		// Group the torrents still to scrape by the next tracker to ask.
+		groups := make(map[string][]int)
+		var order []string
+		for i := range torrents {
+			if results[i].Tracker != "" || len(candidates[i]) == 0 {
+				continue
+			}
+
+			tracker := candidates[i][0]
+			if _, ok := groups[tracker]; !ok {
+				order = append(order, tracker)
+			}
+			groups[tracker] = append(groups[tracker], i)
+		}
+
+		if len(order) == 0 {
+			return results
+		}
+
+		if err := ctx.Err(); err != nil {
+			for _, group := range groups {
+				for _, i := range group {
+					results[i].Err = err
+				}
+			}
+			return results
+		}
+
+		for _, tracker := range order {
+			group := groups[tracker]
+			hashes := make([][]byte, len(group))
+			for j, i := range group {
+				hashes[j] = infoHashes[i]
+			}
+
+			stats, err := ScrapeContext(ctx, tracker, hashes)
+			for j, i := range group {
+				candidates[i] = candidates[i][1:]
+				if err != nil {
+					results[i].Err = err
+					continue
+				}
+				results[i] = ScrapeResult{ScrapeStats: stats[j], Tracker: tracker}
+			}
+		}
+	}
+}
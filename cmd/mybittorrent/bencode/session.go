@@ -0,0 +1,103 @@
+package bencode
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	clientPrefix   = "-MB0001-" // Azureus-style peer id prefix: client "MB", version 0.0.0.1
+	defaultPort    = 6881
+	defaultNumWant = 50
+	unknownLeft    = 16 * 1024 // left reported while a torrent's length is unknown, so trackers don't take us for a seed
+	peerIDChars    = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// Session is the identity this client presents to trackers and peers. Every
+// announce and handshake of the process uses the same peer id and key, so
+// that trackers and peers can tell our connections apart from other
+// clients'. Fields may be changed before the first announce or handshake.
+type Session struct {
+	PeerID  []byte // 20 bytes: clientPrefix followed by random characters
+	Key     uint32 // lets trackers recognise us if our IP changes
+	Port    int    // TCP port peers are accepted on and reported to trackers; see Listener
+	IP      string // IPv4 address to report to trackers, if not the one they see
+	IPv6    string // IPv6 address to report to trackers (BEP 7)
+	NumWant int    // peers to ask trackers for in each announce
+
+	listenOnce sync.Once
+	listener   *PeerListener
+	listenErr  error
+}
+
+var (
+	sessionOnce sync.Once
+	session     *Session
+)
+
+// CurrentSession returns the session of this process, creating it with a new
+// peer id and key on first use.
+func CurrentSession() *Session {
+	sessionOnce.Do(func() {
+		random := make([]byte, 20-len(clientPrefix)+4)
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+
+		peerId := []byte(clientPrefix)
+		for _, b := range random[4:] {
+			peerId = append(peerId, peerIDChars[int(b)%len(peerIDChars)])
+		}
+
+		session = &Session{
+			PeerID:  peerId,
+			Key:     binary.BigEndian.Uint32(random[:4]),
+			Port:    defaultPort,
+			NumWant: defaultNumWant,
+		}
+	})
+	return session
+}
+
+// TransferStats counts the bytes of a torrent transferred in this session,
+// as reported to its trackers. It is safe for concurrent use.
+type TransferStats struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	left       atomic.Int64
+}
+
+// NewTransferStats creates the stats of a download with left bytes to go.
+func NewTransferStats(left int64) *TransferStats {
+	s := &TransferStats{}
+	s.left.Store(left)
+	return s
+}
+
+// Downloaded records n bytes of verified data, which no longer count as left.
+func (s *TransferStats) Downloaded(n int64) {
+	s.downloaded.Add(n)
+	s.left.Add(-n)
+}
+
+// Uploaded records n bytes of data sent to peers.
+func (s *TransferStats) Uploaded(n int64) {
+	s.uploaded.Add(n)
+}
+
+// Snapshot returns the bytes uploaded, downloaded and left.
+func (s *TransferStats) Snapshot() (uploaded, downloaded, left int64) {
+	return s.uploaded.Load(), s.downloaded.Load(), max(s.left.Load(), 0)
+}
+
+// torrentLeft returns the bytes left to download a torrent from scratch. The
+// length of a torrent known only from a magnet link is unknown until its
+// metadata is fetched, and is reported as unknownLeft until then.
+func torrentLeft(t TorrentInfo) int64 {
+	if t.Length == 0 && t.RawInfo == nil {
+		return unknownLeft
+	}
+	return t.Length
+}
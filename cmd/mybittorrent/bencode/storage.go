@@ -0,0 +1,100 @@
+package bencode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// fileLayout maps the contiguous data of a torrent onto its files on disk.
+type fileLayout struct {
+	files []layoutFile
+}
+
+type layoutFile struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// newFileLayout lays out the files of t under root. For a single-file torrent
+// root is the path of the file itself; for a multi-file torrent it is the
+// directory that takes the place of the torrent's name.
+func newFileLayout(t TorrentInfo, root string) fileLayout {
+	if !t.IsMultiFile() {
+		return fileLayout{files: []layoutFile{{path: root, length: t.Length}}}
+	}
+
+	files := make([]layoutFile, 0, len(t.Files))
+	for _, file := range t.Files {
+		// Padding files (BEP 47) only exist in the torrent's data; their
+		// bytes are zeros and are never written to disk.
+		if file.Padding {
+			continue
+		}
+
+		files = append(files, layoutFile{
+			path:   filepath.Join(append([]string{root}, file.Path...)...),
+			offset: file.Offset,
+			length: file.Length,
+		})
+	}
+	return fileLayout{files: files}
+}
+
+// create creates every file of the layout with its final size, so that empty
+// files exist and pieces can be written in any order.
+func (l fileLayout) create() error {
+	for _, file := range l.files {
+		if err := os.MkdirAll(filepath.Dir(file.path), os.ModePerm); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(file.path, os.O_RDWR|os.O_CREATE, os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		err = f.Truncate(file.length)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAt writes data at offset in the torrent's data, splitting it across
+// every file it overlaps. Pieces routinely span the boundary between files.
+func (l fileLayout) writeAt(data []byte, offset int64) error {
+	end := offset + int64(len(data))
+	for _, file := range l.files {
+		fileEnd := file.offset + file.length
+		if fileEnd <= offset || file.offset >= end {
+			continue
+		}
+
+		from := max(offset, file.offset)
+		to := min(end, fileEnd)
+		if err := writeFileAt(file.path, data[from-offset:to-offset], from-file.offset); err != nil {
+			return fmt.Errorf("error writing %s: %w", file.path, err)
+		}
+	}
+	return nil
+}
+
+// writeFileAt writes data at offset in the file at path.
+func writeFileAt(path string, data []byte, offset int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(data, offset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
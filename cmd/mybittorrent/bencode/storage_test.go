@@ -0,0 +1,49 @@
+package bencode
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLayoutWriteAt(t *testing.T) {
+	data := []byte("aaaaa\x00\x00\x00bbbbbbbccc")
+	torrent := TorrentInfo{
+		Info: map[string]interface{}{"files": []interface{}{}},
+		Files: []File{
+			{Path: []string{"a.txt"}, Length: 5, Offset: 0},
+			{Path: []string{".pad", "3"}, Length: 3, Offset: 5, Padding: true},
+			{Path: []string{"dir", "b.txt"}, Length: 7, Offset: 8},
+			{Path: []string{"c.txt"}, Length: 3, Offset: 15},
+		},
+	}
+
+	root := t.TempDir()
+	layout := newFileLayout(torrent, root)
+	if err := layout.create(); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// Pieces of 6 bytes, written out of order: each spans a file boundary.
+	for _, offset := range []int{12, 6, 0} {
+		if err := layout.writeAt(data[offset:min(offset+6, len(data))], int64(offset)); err != nil {
+			t.Fatalf("writeAt(%d): %v", offset, err)
+		}
+	}
+
+	want := map[string]string{"a.txt": "aaaaa", "dir/b.txt": "bbbbbbb", "c.txt": "ccc"}
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, []byte(content)) {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding file was written to disk: %v", err)
+	}
+}
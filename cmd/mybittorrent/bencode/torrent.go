@@ -1,18 +1,46 @@
 package bencode
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 type TorrentInfo struct {
-	Announce    string
-	Length      int64
-	Info        map[string]interface{}
-	InfoHash    string
-	PieceLength int64
-	PieceHashes []string
+	Announce     string
+	AnnounceList [][]string // tracker tiers (BEP 12)
+	CreationDate time.Time  // zero if not set
+	CreatedBy    string
+	Comment      string
+	URLList      []string // web seeds (BEP 19)
+	HTTPSeeds    []string // HTTP seeds (BEP 17)
+	Name         string
+	Files        []File
+	Length       int64 // total length of all files
+	Private      bool  // peers may only be obtained from the trackers (BEP 27)
+	Info         map[string]interface{}
+	RawInfo      []byte // info dictionary exactly as encoded in the torrent file
+	InfoHash     string // hex SHA-1 of the info dictionary; empty for v2-only torrents
+	InfoHashV2   string // hex SHA-256 of the info dictionary (BEP 52); empty for v1 torrents
+	MetaVersion  int    // 2 for v2 and hybrid torrents, 1 otherwise
+	PieceLength  int64
+	PieceHashes  []string               // v1 SHA-1 piece hashes
+	PieceLayers  map[string][]byte      // v2 piece layers, keyed by the pieces root of their file
+	Extra        map[string]interface{} // top-level metainfo keys not listed above
+}
+
+// File is a single file of a torrent.
+type File struct {
+	Path       []string // path components relative to the torrent's root directory
+	Length     int64
+	Offset     int64  // offset of the file's first byte in the torrent's data
+	PiecesRoot []byte // root of the file's v2 merkle tree; nil for v1 torrents and empty files
+	Padding    bool   // padding file (BEP 47) that aligns the next file to a piece boundary
 }
 
 func (t TorrentInfo) PrintStats() {
@@ -25,9 +53,239 @@ func (t TorrentInfo) PrintStats() {
 	for _, hash := range t.PieceHashes {
 		fmt.Printf("\t%v\n", hash)
 	}
+
+	if t.MetaVersion == 2 {
+		fmt.Printf("Meta Version: %v\n", t.MetaVersion)
+		fmt.Printf("Info Hash v2: %v\n", t.InfoHashV2)
+		fmt.Printf("Piece Count: %v\n", t.PieceCount())
+	}
+
+	if t.IsMultiFile() {
+		fmt.Printf("Name: %v\n", t.Name)
+		fmt.Println("Files:")
+		for _, file := range t.Files {
+			if file.Padding {
+				continue
+			}
+			fmt.Printf("\t%v (%d bytes)\n", filepath.Join(file.Path...), file.Length)
+		}
+	}
+
+	if len(t.AnnounceList) > 0 {
+		fmt.Println("Tracker Tiers:")
+		for i, tier := range t.AnnounceList {
+			fmt.Printf("\t%d: %v\n", i, strings.Join(tier, " "))
+		}
+	}
+
+	if !t.CreationDate.IsZero() {
+		fmt.Printf("Creation Date: %v\n", t.CreationDate.Format(time.RFC3339))
+	}
+	if t.CreatedBy != "" {
+		fmt.Printf("Created By: %v\n", t.CreatedBy)
+	}
+	if t.Comment != "" {
+		fmt.Printf("Comment: %v\n", t.Comment)
+	}
+	if t.Private {
+		fmt.Println("Private: yes")
+	}
+
+	for _, seed := range t.URLList {
+		fmt.Printf("Web Seed: %v\n", seed)
+	}
+	for _, seed := range t.HTTPSeeds {
+		fmt.Printf("HTTP Seed: %v\n", seed)
+	}
+
+	extraKeys := make([]string, 0, len(t.Extra))
+	for key := range t.Extra {
+		extraKeys = append(extraKeys, key)
+	}
+	sort.Strings(extraKeys)
+	for _, key := range extraKeys {
+		fmt.Printf("Unknown Key: %v\n", key)
+	}
+}
+
+// IsMultiFile reports whether the torrent describes a directory of files
+// rather than a single file. A v2 file tree describes a single file when it
+// holds nothing but one file at its root.
+func (t TorrentInfo) IsMultiFile() bool {
+	if _, ok := t.Info["files"]; ok {
+		return true
+	}
+
+	if _, ok := t.Info["length"]; ok {
+		return false
+	}
+	return len(t.Files) != 1 || len(t.Files[0].Path) != 1
+}
+
+// PieceCount returns the number of pieces of the torrent.
+func (t TorrentInfo) PieceCount() int {
+	if !t.isV2Only() {
+		return len(t.PieceHashes)
+	}
+
+	var end int64
+	for _, file := range t.Files {
+		if file.Length > 0 {
+			end = file.Offset + file.Length
+		}
+	}
+	return int((end + t.PieceLength - 1) / t.PieceLength)
 }
 
-func verifyPiece(piece []byte, expectedHash []byte) bool {
-	hash := sha1.Sum(piece)
-	return hex.EncodeToString(hash[:]) == string(expectedHash)
+// PieceSize returns the length of the piece at pieceIndex; every piece has
+// the torrent's piece length except the last, which holds the remainder.
+// In a v2-only torrent every file starts on a piece boundary, so the last
+// piece of each file holds the remainder of that file.
+func (t TorrentInfo) PieceSize(pieceIndex int) int64 {
+	start := int64(pieceIndex) * t.PieceLength
+	if !t.isV2Only() {
+		return min(t.PieceLength, t.Length-start)
+	}
+
+	file, ok := t.fileAt(start)
+	if !ok {
+		return 0
+	}
+	return min(t.PieceLength, file.Offset+file.Length-start)
+}
+
+// isV2Only reports whether the torrent has no v1 piece hashes.
+func (t TorrentInfo) isV2Only() bool {
+	return t.MetaVersion == 2 && len(t.PieceHashes) == 0
+}
+
+// fileAt returns the non-empty file containing the byte at offset in the
+// torrent's data. Padding files are not part of any file and are skipped.
+func (t TorrentInfo) fileAt(offset int64) (File, bool) {
+	for _, file := range t.Files {
+		if file.Padding {
+			continue
+		}
+		if file.Offset <= offset && offset < file.Offset+file.Length {
+			return file, true
+		}
+	}
+	return File{}, false
+}
+
+// verifyPiece checks a downloaded piece against every hash the torrent has
+// for it: its v1 SHA-1 hash and, for v2 and hybrid torrents, the merkle tree
+// of its file. A hybrid torrent resolved from a magnet link may lack the piece
+// layers of its files, whose pieces are then checked against the v1 hash only.
+func (t TorrentInfo) verifyPiece(pieceIndex int, piece []byte) bool {
+	if len(t.PieceHashes) > 0 {
+		hash := sha1.Sum(piece)
+		if hex.EncodeToString(hash[:]) != t.PieceHashes[pieceIndex] {
+			return false
+		}
+
+		if t.missingPieceLayer(pieceIndex) {
+			return true
+		}
+	}
+
+	if t.MetaVersion == 2 {
+		return verifyPieceV2(t, pieceIndex, piece)
+	}
+	return true
+}
+
+// missingPieceLayer reports whether the piece at pieceIndex belongs to a file
+// larger than a piece whose piece layer the torrent does not have.
+func (t TorrentInfo) missingPieceLayer(pieceIndex int) bool {
+	file, ok := t.fileAt(int64(pieceIndex) * t.PieceLength)
+	if !ok || file.PiecesRoot == nil || file.Length <= t.PieceLength {
+		return false
+	}
+
+	_, ok = t.PieceLayers[string(file.PiecesRoot)]
+	return !ok
+}
+
+// InfoHashes returns the 20-byte info hashes the torrent is known by to
+// trackers and peers: the SHA-1 info hash of v1 and hybrid torrents, followed
+// by the SHA-256 info hash of v2 and hybrid torrents truncated to 20 bytes
+// (BEP 52). A hybrid torrent has both, and peers may use either.
+//
+// Returns:
+// - A slice of 20-byte info hashes, the preferred one first.
+// - An error if the torrent has no valid info hash.
+func (t TorrentInfo) InfoHashes() ([][]byte, error) {
+	var hashes [][]byte
+	if t.InfoHash != "" {
+		infoHash, err := hex.DecodeString(t.InfoHash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, infoHash)
+	}
+
+	if t.InfoHashV2 != "" {
+		infoHash, err := hex.DecodeString(t.InfoHashV2)
+		if err != nil {
+			return nil, err
+		}
+		if len(infoHash) < sha1.Size {
+			return nil, fmt.Errorf("invalid v2 info hash %q", t.InfoHashV2)
+		}
+		hashes = append(hashes, infoHash[:sha1.Size])
+	}
+
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("missing info hash")
+	}
+	return hashes, nil
+}
+
+// hasInfoHash reports whether infoHash is one of the torrent's info hashes.
+func (t TorrentInfo) hasInfoHash(infoHash []byte) bool {
+	infoHashes, err := t.InfoHashes()
+	if err != nil {
+		return false
+	}
+
+	for _, known := range infoHashes {
+		if bytes.Equal(known, infoHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// PiecesForFiles returns, in order, the indices of the pieces holding any part
+// of the files at the given indices in Files. Every piece is listed once,
+// even if it spans several of the files.
+//
+// Parameters:
+// - fileIndices: A slice of indices into Files; out of range indices are ignored.
+//
+// Returns:
+// - A slice of piece indices.
+func (t TorrentInfo) PiecesForFiles(fileIndices []int) []int {
+	selected := make([]bool, t.PieceCount())
+	for _, i := range fileIndices {
+		if i < 0 || i >= len(t.Files) || t.Files[i].Length == 0 {
+			continue
+		}
+
+		file := t.Files[i]
+		first := file.Offset / t.PieceLength
+		last := (file.Offset + file.Length - 1) / t.PieceLength
+		for p := first; p <= last && p < int64(len(selected)); p++ {
+			selected[p] = true
+		}
+	}
+
+	var pieces []int
+	for i, ok := range selected {
+		if ok {
+			pieces = append(pieces, i)
+		}
+	}
+	return pieces
 }
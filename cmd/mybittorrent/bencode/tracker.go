@@ -0,0 +1,338 @@
+package bencode
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const defaultAnnounceInterval = 30 * time.Minute // used when a tracker does not say
+
+// TrackerEvent is the event an announce reports to trackers.
+type TrackerEvent string
+
+const (
+	EventNone      TrackerEvent = ""          // regular announce
+	EventStarted   TrackerEvent = "started"   // first announce of a download
+	EventCompleted TrackerEvent = "completed" // the download has just finished
+	EventStopped   TrackerEvent = "stopped"   // we are leaving the swarm
+)
+
+// AnnounceRequest is an announce of a torrent to a tracker.
+type AnnounceRequest struct {
+	InfoHash   []byte // 20-byte info hash the torrent is tracked under
+	PeerID     []byte // 20-byte peer id
+	Port       int    // TCP port peers can reach us on
+	Uploaded   int64  // bytes uploaded since the started event
+	Downloaded int64  // bytes downloaded since the started event
+	Left       int64  // bytes still to download
+	Event      TrackerEvent
+	TrackerID  string // tracker id the tracker handed out in an earlier response, if any
+	NumWant    int    // peers wanted; negative leaves it to the tracker
+	Key        uint32 // session key (see Session)
+	IP         string // IPv4 address to report, if any
+	IPv6       string // IPv6 address to report (BEP 7), if any
+}
+
+// TrackerStatus is the state of one tracker of a TrackerManager.
+type TrackerStatus struct {
+	URL          string
+	Tier         int           // index of the tracker's tier in the announce list
+	Working      bool          // whether the last announce succeeded
+	LastAnnounce time.Time     // time of the last successful announce; zero if none
+	LastError    error         // error of the last failed announce, if any
+	Warning      string        // warning message of the last successful announce, if any
+	Interval     time.Duration // time the tracker asks us to wait between regular announces
+	MinInterval  time.Duration // time the tracker requires between regular announces; zero if none
+	TrackerID    string        // tracker id to send back in later announces
+	Peers        int           // peers reported by the last successful announce
+	Complete     int64         // seeders reported by the last successful announce
+	Incomplete   int64         // leechers reported by the last successful announce
+}
+
+// TrackerManager announces a torrent to its trackers as BEP 12 describes:
+// trackers are grouped into tiers, each tier is shuffled once, and within a
+// tier trackers are tried in order until one answers, which then moves to
+// the front of its tier. By default tiers are tried in order until one
+// answers; with Parallel set, every tier is announced to at once. It is safe
+// for concurrent use.
+type TrackerManager struct {
+	Parallel bool           // announce to every tier at once rather than stopping at the first that answers
+	Stats    *TransferStats // bytes transferred, reported in every announce
+	HTTP     *HTTPTracker   // client of HTTP trackers; nil uses DefaultHTTPTracker
+
+	t     TorrentInfo
+	mu    sync.Mutex
+	tiers [][]*TrackerStatus
+}
+
+// NewTrackerManager creates a TrackerManager for the trackers of a torrent:
+// the tiers of its announce list or, if it has none, its announce URL. Empty
+// tiers are left out. The stats start with the whole torrent left; for a
+// torrent known only from a magnet link, whose length is unknown, a nominal
+// amount is reported instead, and a new TrackerManager should be created once
+// the metadata is resolved.
+//
+// Parameters:
+// - t: A TorrentInfo struct containing the torrent metadata.
+//
+// Returns:
+// - A pointer to the TrackerManager.
+func NewTrackerManager(t TorrentInfo) *TrackerManager {
+	announceList := t.AnnounceList
+	if len(announceList) == 0 && t.Announce != "" {
+		announceList = [][]string{{t.Announce}}
+	}
+
+	m := &TrackerManager{t: t, Stats: NewTransferStats(torrentLeft(t))}
+	for _, urls := range announceList {
+		if len(urls) == 0 {
+			continue
+		}
+
+		tier := make([]*TrackerStatus, len(urls))
+		for j, url := range urls {
+			tier[j] = &TrackerStatus{URL: url, Tier: len(m.tiers)}
+		}
+		rand.Shuffle(len(tier), func(a, b int) { tier[a], tier[b] = tier[b], tier[a] })
+		m.tiers = append(m.tiers, tier)
+	}
+	return m
+}
+
+// Announce announces the torrent with the given event, as AnnounceContext
+// does with a background context.
+//
+// Parameters:
+// - event: The event to report.
+//
+// Returns:
+// - A slice of strings, each representing a peer in the format "IP:port".
+// - An error if no tracker could be announced to.
+func (m *TrackerManager) Announce(event TrackerEvent) ([]string, error) {
+	return m.AnnounceContext(context.Background(), event)
+}
+
+// AnnounceContext announces the torrent with the given event and returns the
+// peers reported, without duplicates. Cancelling ctx aborts the requests to
+// HTTP and UDP trackers alike.
+//
+// Regular announces skip a tier whose working tracker was announced to less
+// than its min interval ago. The completed and stopped events only go to the
+// trackers that are working, since the others never saw us start.
+//
+// Parameters:
+// - ctx: A context that cancels the announces.
+// - event: The event to report.
+//
+// Returns:
+// - A slice of strings, each representing a peer in the format "IP:port".
+// - An error if no tracker could be announced to.
+func (m *TrackerManager) AnnounceContext(ctx context.Context, event TrackerEvent) ([]string, error) {
+	if len(m.tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	var peers []string
+	seen := make(map[string]bool)
+	var lastErr error
+	succeeded := false
+	collect := func(found []string, err error) {
+		if err != nil {
+			lastErr = err
+			return
+		}
+
+		succeeded = true
+		for _, peer := range found {
+			if !seen[peer] {
+				seen[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	if event == EventCompleted || event == EventStopped {
+		for _, st := range m.Status() {
+			if st.Working {
+				collect(m.announceTracker(ctx, st.Tier, st.URL, event))
+			}
+		}
+	} else if m.Parallel {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for i := range m.tiers {
+			wg.Add(1)
+			go func(tier int) {
+				defer wg.Done()
+				found, err := m.announceTier(ctx, tier, event)
+
+				mu.Lock()
+				defer mu.Unlock()
+				collect(found, err)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range m.tiers {
+			found, err := m.announceTier(ctx, i, event)
+			collect(found, err)
+			if err == nil {
+				break
+			}
+		}
+	}
+
+	if !succeeded {
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// announceTier announces to the trackers of a tier in order until one answers.
+func (m *TrackerManager) announceTier(ctx context.Context, tier int, event TrackerEvent) ([]string, error) {
+	m.mu.Lock()
+	urls := make([]string, len(m.tiers[tier]))
+	for i, st := range m.tiers[tier] {
+		urls[i] = st.URL
+	}
+	front := *m.tiers[tier][0]
+	m.mu.Unlock()
+
+	if event == EventNone && front.Working && time.Since(front.LastAnnounce) < front.MinInterval {
+		return nil, nil
+	}
+
+	var lastErr error
+	for _, url := range urls {
+		found, err := m.announceTracker(ctx, tier, url, event)
+		if err == nil {
+			return found, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// announceTracker announces the torrent to one tracker under each of its info
+// hashes and records the outcome in the tracker's status. A tracker that
+// answers moves to the front of its tier.
+func (m *TrackerManager) announceTracker(ctx context.Context, tier int, url string, event TrackerEvent) ([]string, error) {
+	infoHashes, err := m.t.InfoHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	trackerID := m.find(tier, url).TrackerID
+	m.mu.Unlock()
+
+	h := m.HTTP
+	if h == nil {
+		h = DefaultHTTPTracker
+	}
+
+	var peers []string
+	var last *TrackerResponse
+	var lastErr error
+	for _, infoHash := range infoHashes {
+		req := newAnnounceRequest(m.t, infoHash, event, m.Stats)
+		req.TrackerID = trackerID
+
+		resp, err := announceTo(ctx, h, url, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		last = resp
+		for _, peer := range resp.Peers {
+			peers = append(peers, peer.String())
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := m.find(tier, url)
+	if last == nil {
+		st.Working = false
+		st.LastError = lastErr
+		return nil, fmt.Errorf("tracker %s: %w", url, lastErr)
+	}
+
+	st.Working = true
+	st.LastAnnounce = time.Now()
+	st.LastError = nil
+	st.Warning = last.WarningMessage
+	st.Interval = defaultAnnounceInterval
+	if last.Interval > 0 {
+		st.Interval = time.Duration(last.Interval) * time.Second
+	}
+	st.MinInterval = time.Duration(last.MinInterval) * time.Second
+	if last.TrackerID != "" {
+		st.TrackerID = last.TrackerID
+	}
+	st.Peers = len(peers)
+	st.Complete = last.Complete
+	st.Incomplete = last.Incomplete
+	m.promote(tier, st)
+	return peers, nil
+}
+
+// find returns the status of the tracker with the given URL in a tier.
+// m.mu must be held.
+func (m *TrackerManager) find(tier int, url string) *TrackerStatus {
+	for _, st := range m.tiers[tier] {
+		if st.URL == url {
+			return st
+		}
+	}
+	return nil
+}
+
+// promote moves a tracker to the front of its tier. m.mu must be held.
+func (m *TrackerManager) promote(tier int, st *TrackerStatus) {
+	trackers := m.tiers[tier]
+	for i, other := range trackers {
+		if other == st {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = st
+			return
+		}
+	}
+}
+
+// Status returns the status of every tracker, tier by tier, in the order
+// they are tried.
+func (m *TrackerManager) Status() []TrackerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var status []TrackerStatus
+	for _, tier := range m.tiers {
+		for _, st := range tier {
+			status = append(status, *st)
+		}
+	}
+	return status
+}
+
+// NextAnnounce returns when the next regular announce is due: the earliest
+// time a working tracker asked us to announce again. It is the zero time if
+// no tracker is working.
+func (m *TrackerManager) NextAnnounce() time.Time {
+	var next time.Time
+	for _, st := range m.Status() {
+		if !st.Working {
+			continue
+		}
+
+		if due := st.LastAnnounce.Add(st.Interval); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
@@ -0,0 +1,236 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTrackerTimeout   = 30 * time.Second
+	defaultTrackerRedirects = 5
+	defaultUserAgent        = "mybittorrent/0.0.1"
+	maxTrackerResponseSize  = 4 << 20 // larger responses are cut off and fail to parse
+)
+
+// HTTPTrackerOptions configures the HTTP client of an HTTPTracker.
+type HTTPTrackerOptions struct {
+	Timeout      time.Duration // limit on each request, reading the response included; zero uses 30 seconds
+	MaxRedirects int           // redirects followed per request; zero uses 5, negative follows none
+	Proxy        string        // URL of an http, https or socks5 proxy; empty uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	UserAgent    string        // User-Agent header; empty uses "mybittorrent/0.0.1"
+}
+
+// HTTPTracker sends announces and scrapes to HTTP trackers. Responses may be
+// gzip-compressed. It is safe for concurrent use.
+type HTTPTracker struct {
+	Client    *http.Client // client every request goes through
+	UserAgent string       // User-Agent header of every request
+}
+
+// DefaultHTTPTracker is the HTTPTracker used by CallTracker, Scrape and every
+// TrackerManager without one of its own.
+var DefaultHTTPTracker = newHTTPTracker(HTTPTrackerOptions{}, nil)
+
+// NewHTTPTracker creates an HTTPTracker with its own HTTP client.
+//
+// Parameters:
+// - opts: The timeout, redirect limit, proxy and User-Agent of the client.
+//
+// Returns:
+// - A pointer to the HTTPTracker.
+// - An error if the proxy URL is invalid.
+func NewHTTPTracker(opts HTTPTrackerOptions) (*HTTPTracker, error) {
+	var proxy *url.URL
+	if opts.Proxy != "" {
+		var err error
+		proxy, err = url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %w", opts.Proxy, err)
+		}
+
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy URL %q", opts.Proxy)
+		}
+	}
+	return newHTTPTracker(opts, proxy), nil
+}
+
+// newHTTPTracker creates an HTTPTracker going through proxy, or through the
+// proxy of the environment if proxy is nil.
+func newHTTPTracker(opts HTTPTrackerOptions, proxy *url.URL) *HTTPTracker {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTrackerTimeout
+	}
+	maxRedirects := opts.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultTrackerRedirects
+	}
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &HTTPTracker{
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", max(maxRedirects, 0))
+				}
+				return nil
+			},
+		},
+		UserAgent: userAgent,
+	}
+}
+
+// Announce sends an announce request to an HTTP tracker.
+//
+// Parameters:
+// - ctx: A context that cancels the request.
+// - tracker: The announce URL of the tracker.
+// - req: The announce to send.
+//
+// Returns:
+// - A pointer to the TrackerResponse.
+// - A *TrackerFailure if the tracker refused the announce, or an error if any other step fails.
+func (h *HTTPTracker) Announce(ctx context.Context, tracker string, req AnnounceRequest) (*TrackerResponse, error) {
+	params := url.Values{
+		"info_hash":  {string(req.InfoHash)},
+		"peer_id":    {string(req.PeerID)},
+		"port":       {strconv.Itoa(req.Port)},
+		"uploaded":   {strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": {strconv.FormatInt(req.Downloaded, 10)},
+		"left":       {strconv.FormatInt(req.Left, 10)},
+		"compact":    {"1"},
+	}
+	if req.Event != EventNone {
+		params.Set("event", string(req.Event))
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+	if req.NumWant >= 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != 0 {
+		params.Set("key", fmt.Sprintf("%08x", req.Key))
+	}
+	if req.IP != "" {
+		params.Set("ip", req.IP)
+	}
+	if req.IPv6 != "" {
+		params.Set("ipv6", req.IPv6)
+	}
+
+	data, err := h.get(ctx, tracker, params)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTrackerResponse(data)
+}
+
+// Scrape sends a scrape request for every info hash to an HTTP tracker.
+//
+// Parameters:
+// - ctx: A context that cancels the request.
+// - tracker: The announce URL of the tracker.
+// - infoHashes: The 20-byte info hashes of the torrents.
+//
+// Returns:
+// - The stats of each torrent, in the order of infoHashes; torrents the tracker does not know have zero stats.
+// - A *TrackerFailure if the tracker refused the scrape, or an error if any other step fails.
+func (h *HTTPTracker) Scrape(ctx context.Context, tracker string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	scrapeURL, err := ScrapeURL(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash))
+	}
+
+	data, err := h.get(ctx, scrapeURL, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded scrapeResponse
+	decoder := NewDecoder(bytes.NewReader(data))
+	decoder.SetLimits(trackerLimits)
+	if err := decoder.DecodeInto(&decoded); err != nil {
+		return nil, fmt.Errorf("invalid scrape response: %w", err)
+	}
+	if decoded.FailureReason != "" {
+		return nil, &TrackerFailure{Reason: decoded.FailureReason}
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		file := decoded.Files[string(infoHash)]
+		stats[i] = ScrapeStats{Complete: file.Complete, Incomplete: file.Incomplete, Downloaded: file.Downloaded}
+	}
+	return stats, nil
+}
+
+// get sends a GET request with the given query parameters to a tracker and
+// returns the body of its response, decompressed if it is gzipped.
+func (h *HTTPTracker) get(ctx context.Context, tracker string, params url.Values) ([]byte, error) {
+	separator := "?"
+	if strings.Contains(tracker, "?") {
+		separator = "&"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tracker+separator+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL %q: %w", tracker, err)
+	}
+	req.Header.Set("User-Agent", h.UserAgent)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker %s answered %s", tracker, resp.Status)
+	}
+
+	// Some trackers gzip their responses without saying so; a bencoded
+	// response never starts with the gzip magic number.
+	body := bufio.NewReader(resp.Body)
+	magic, _ := body.Peek(2)
+	var r io.Reader = body
+	if resp.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzipped response: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return io.ReadAll(io.LimitReader(r, maxTrackerResponseSize))
+}
@@ -0,0 +1,186 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TrackerResponse is the answer of a tracker to an announce.
+type TrackerResponse struct {
+	WarningMessage string // message to show the user; the announce still succeeded
+	Interval       int64  // seconds to wait before announcing again
+	MinInterval    int64  // seconds that must pass between announces; zero if not given
+	TrackerID      string // id to send back in later announces to this tracker
+	Complete       int64  // seeders
+	Incomplete     int64  // leechers
+	Peers          []PeerAddr
+}
+
+// PeerAddr is the address of a peer reported by a tracker.
+type PeerAddr struct {
+	IP     net.IP
+	Host   string // DNS name of the peer if the tracker gave one instead of an IP; IP is nil then
+	Port   int
+	PeerID []byte // nil if the tracker sent a compact peer list
+}
+
+// String returns the address in the format "IP:port", or "host:port" for a
+// peer known by its DNS name.
+func (p PeerAddr) String() string {
+	if p.IP == nil {
+		return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	}
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// ParseTrackerResponse parses the bencoded response of an HTTP tracker. Peers
+// may be listed in compact form (BEP 23) or as a list of dictionaries, and
+// IPv6 peers in compact form under "peers6" (BEP 7).
+//
+// Parameters:
+// - data: A byte slice containing the response from the tracker.
+//
+// Returns:
+// - A pointer to the parsed TrackerResponse.
+// - A *TrackerFailure if the tracker refused the announce, or an error if the response is malformed.
+func ParseTrackerResponse(data []byte) (*TrackerResponse, error) {
+	decoder := NewDecoder(bytes.NewReader(data))
+	decoder.SetLimits(trackerLimits)
+	decoded, err := decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker response is not a dictionary")
+	}
+
+	if reason, ok := dict["failure reason"].([]byte); ok {
+		return nil, &TrackerFailure{Reason: string(reason)}
+	}
+
+	resp := &TrackerResponse{}
+	resp.WarningMessage, _ = stringValue(dict["warning message"])
+	resp.TrackerID, _ = stringValue(dict["tracker id"])
+	resp.Interval, _ = dict["interval"].(int64)
+	resp.MinInterval, _ = dict["min interval"].(int64)
+	resp.Complete, _ = dict["complete"].(int64)
+	resp.Incomplete, _ = dict["incomplete"].(int64)
+
+	switch peers := dict["peers"].(type) {
+	case []byte:
+		resp.Peers, err = decodeCompactPeerAddrs(peers, net.IPv4len)
+		if err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		resp.Peers = parsePeerDicts(peers)
+	case nil:
+		if _, ok := dict["peers6"]; !ok {
+			return nil, fmt.Errorf("missing peers")
+		}
+	default:
+		return nil, fmt.Errorf("invalid peers of type %T", peers)
+	}
+
+	if peers6, ok := dict["peers6"].([]byte); ok {
+		addrs, err := decodeCompactPeerAddrs(peers6, net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		resp.Peers = append(resp.Peers, addrs...)
+	}
+	return resp, nil
+}
+
+// stringValue returns a bencoded byte string as a string.
+func stringValue(value interface{}) (string, bool) {
+	b, ok := value.([]byte)
+	return string(b), ok
+}
+
+// parsePeerDicts reads a non-compact peer list: a list of dictionaries
+// holding the "ip", "port" and, optionally, "peer id" of each peer. The "ip"
+// may also be a DNS name (BEP 3), which is kept unresolved and looked up when
+// the peer is dialled. Entries without a valid address and port are skipped.
+func parsePeerDicts(list []interface{}) []PeerAddr {
+	var peers []PeerAddr
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		host, _ := stringValue(dict["ip"])
+		ip := net.ParseIP(host)
+		port, _ := dict["port"].(int64)
+		if (ip == nil && !isHostname(host)) || port <= 0 || port > 65535 {
+			continue
+		}
+
+		peer := PeerAddr{IP: ip, Port: int(port)}
+		if ip == nil {
+			peer.Host = host
+		}
+		if id, ok := dict["peer id"].([]byte); ok && len(id) == 20 {
+			peer.PeerID = id
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// isHostname reports whether host is a syntactically valid DNS name: dot
+// separated labels of letters, digits and hyphens, none starting or ending
+// with a hyphen.
+func isHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// decodeCompactPeerAddrs decodes a list of peers in compact form: each peer
+// is an IPv4 or IPv6 address of ipSize bytes followed by a 2-byte port.
+//
+// Parameters:
+// - data: A byte slice containing the concatenated peers.
+// - ipSize: The length of each address, net.IPv4len or net.IPv6len.
+//
+// Returns:
+// - A slice of PeerAddr, one per peer.
+// - An error if the data is not a whole number of peers.
+func decodeCompactPeerAddrs(data []byte, ipSize int) ([]PeerAddr, error) {
+	portSize := 2
+	if len(data)%(ipSize+portSize) != 0 {
+		return nil, fmt.Errorf("compact peer list of %d bytes is not a multiple of %d", len(data), ipSize+portSize)
+	}
+
+	var peers []PeerAddr
+	for i := 0; i < len(data); i += ipSize + portSize {
+		ip := make(net.IP, ipSize)
+		copy(ip, data[i:i+ipSize])
+		portStart := i + ipSize
+		port := binary.BigEndian.Uint16(data[portStart : portStart+portSize])
+		peers = append(peers, PeerAddr{IP: ip, Port: int(port)})
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,111 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTrackerResponse(t *testing.T) {
+	compact := "\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x1a\xe2"
+	compact6 := "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\x1a\xe1"
+	peerID := strings.Repeat("p", 20)
+
+	tests := []struct {
+		name  string
+		input string
+		want  *TrackerResponse // Peers is compared through peers
+		peers []string
+	}{
+		{
+			"compact",
+			"d8:intervali1800e5:peers12:" + compact + "e",
+			&TrackerResponse{Interval: 1800},
+			[]string{"10.0.0.1:6881", "192.168.1.2:6882"},
+		},
+		{
+			"every field",
+			"d8:completei5e10:incompletei3e8:intervali900e12:min intervali60e5:peers0:10:tracker id3:abc15:warning message4:slowe",
+			&TrackerResponse{WarningMessage: "slow", Interval: 900, MinInterval: 60, TrackerID: "abc", Complete: 5, Incomplete: 3},
+			nil,
+		},
+		{
+			"dictionary peers",
+			"d8:intervali60e5:peersld2:ip8:10.0.0.17:peer id20:" + peerID + "4:porti6881eed2:ip7:bad ip!4:porti1eed2:ip3:::14:porti70000eed2:ip3:::14:porti51413eeee",
+			&TrackerResponse{Interval: 60},
+			[]string{"10.0.0.1:6881", "[::1]:51413"},
+		},
+		{
+			"dictionary peers by DNS name",
+			"d8:intervali60e5:peersld2:ip12:peer.example4:porti6881eed2:ip5:-bad-4:porti6881eed2:ip13:seed.example.4:porti51413eeee",
+			&TrackerResponse{Interval: 60},
+			[]string{"peer.example:6881", "seed.example.:51413"},
+		},
+		{
+			"peers6",
+			"d8:intervali60e5:peers6:" + compact[:6] + "6:peers618:" + compact6 + "e",
+			&TrackerResponse{Interval: 60},
+			[]string{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+		},
+		{
+			"peers6 only",
+			"d8:intervali60e6:peers618:" + compact6 + "e",
+			&TrackerResponse{Interval: 60},
+			[]string{"[2001:db8::1]:6881"},
+		},
+		{"not a dictionary", "li1ee", nil, nil},
+		{"missing peers", "d8:intervali60ee", nil, nil},
+		{"truncated compact peers", "d5:peers5:" + compact[:5] + "e", nil, nil},
+		{"invalid peers type", "d5:peersi1ee", nil, nil},
+		{"truncated response", "d8:intervali60e5:peers12:" + compact[:4], nil, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTrackerResponse([]byte(tt.input))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: ParseTrackerResponse = %+v, want an error", tt.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: ParseTrackerResponse: %v", tt.name, err)
+			continue
+		}
+
+		var peers []string
+		for _, peer := range got.Peers {
+			peers = append(peers, peer.String())
+		}
+		if !reflect.DeepEqual(peers, tt.peers) {
+			t.Errorf("%s: peers = %v, want %v", tt.name, peers, tt.peers)
+		}
+
+		got.Peers = nil
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseTrackerResponse = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrackerResponsePeerID(t *testing.T) {
+	peerID := strings.Repeat("p", 20)
+	resp, err := ParseTrackerResponse([]byte("d5:peersld2:ip8:10.0.0.17:peer id20:" + peerID + "4:porti6881eeee"))
+	if err != nil {
+		t.Fatalf("ParseTrackerResponse: %v", err)
+	}
+	if len(resp.Peers) != 1 || string(resp.Peers[0].PeerID) != peerID {
+		t.Fatalf("ParseTrackerResponse peers = %+v, want one with peer id %q", resp.Peers, peerID)
+	}
+}
+
+func TestParseTrackerResponseFailure(t *testing.T) {
+	_, err := ParseTrackerResponse([]byte("d14:failure reason12:unregisterede"))
+
+	var failure *TrackerFailure
+	if !errors.As(err, &failure) || failure.Reason != "unregistered" {
+		t.Fatalf("ParseTrackerResponse = %v, want a *TrackerFailure with reason %q", err, "unregistered")
+	}
+}
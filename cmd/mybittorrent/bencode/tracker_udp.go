@@ -0,0 +1,315 @@
+package bencode
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID     = 0x41727101980 // magic connection id of connect requests
+	udpConnIDLifetime = time.Minute   // how long a connection id may be used
+	udpBaseTimeout    = 15 * time.Second
+	udpMaxRetries     = 8           // the last retransmission waits 15 * 2^8 seconds
+	udpMaxWait        = time.Minute // total time a request through udpTrackerFor may take
+	udpMaxPacketSize  = 64 * 1024
+	udpMaxScrape      = 74 // info hashes in one scrape request
+)
+
+// Actions of UDP tracker requests and responses (BEP 15).
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// UDPTracker is a client of a UDP tracker (BEP 15). The connection id handed
+// out by the tracker is kept and reused for a minute. It is safe for
+// concurrent use.
+type UDPTracker struct {
+	Addr       string        // address of the tracker in the format "host:port"
+	Timeout    time.Duration // time to wait for the first answer; doubled on every retransmission
+	MaxRetries int           // retransmissions before giving up
+	MaxWait    time.Duration // total time a request may take, retransmissions included; zero follows the whole schedule
+
+	mu          sync.Mutex
+	connID      uint64
+	connIDUntil time.Time
+}
+
+var (
+	udpTrackersMu sync.Mutex
+	udpTrackers   = make(map[string]*UDPTracker)
+)
+
+// udpTrackerFor returns the client of the UDP tracker at the host of u,
+// shared by every announce to it so that its connection id is reused. A
+// request gives up after udpMaxWait rather than following the whole BEP 15
+// schedule, which lasts over two hours, so that a dead tracker does not hold
+// up the commands announcing to it.
+func udpTrackerFor(u *url.URL) *UDPTracker {
+	udpTrackersMu.Lock()
+	defer udpTrackersMu.Unlock()
+
+	tr, ok := udpTrackers[u.Host]
+	if !ok {
+		tr = NewUDPTracker(u.Host)
+		tr.MaxWait = udpMaxWait
+		udpTrackers[u.Host] = tr
+	}
+	return tr
+}
+
+// NewUDPTracker creates a client of the UDP tracker at addr, with the
+// retransmission schedule of BEP 15.
+func NewUDPTracker(addr string) *UDPTracker {
+	return &UDPTracker{Addr: addr, Timeout: udpBaseTimeout, MaxRetries: udpMaxRetries}
+}
+
+// udpEvents maps announce events to their codes in UDP announce requests.
+var udpEvents = map[TrackerEvent]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// Announce announces a torrent to the tracker.
+//
+// Parameters:
+// - ctx: A context that cancels the request and its retransmissions.
+// - req: An AnnounceRequest describing the torrent and our progress.
+//
+// Returns:
+// - A pointer to the tracker's answer.
+// - A *TrackerFailure if the tracker answers with an error, or an error if it does not answer or the answer is malformed.
+func (tr *UDPTracker) Announce(ctx context.Context, req AnnounceRequest) (*TrackerResponse, error) {
+	if len(req.InfoHash) != 20 || len(req.PeerID) != 20 {
+		return nil, fmt.Errorf("invalid info hash or peer id length")
+	}
+
+	body := make([]byte, 0, 82)
+	body = append(body, req.InfoHash...)
+	body = append(body, req.PeerID...)
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Downloaded))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Left))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Uploaded))
+	body = binary.BigEndian.AppendUint32(body, udpEvents[req.Event])
+
+	// The IP field only holds an IPv4 address; zero asks the tracker to use the sender's.
+	ip := net.IPv4zero.To4()
+	if reported := net.ParseIP(req.IP).To4(); reported != nil {
+		ip = reported
+	}
+	body = append(body, ip...)
+	body = binary.BigEndian.AppendUint32(body, req.Key)
+	body = binary.BigEndian.AppendUint32(body, uint32(int32(req.NumWant))) // -1 asks for the tracker's default
+	body = binary.BigEndian.AppendUint16(body, uint16(req.Port))
+
+	payload, ipSize, err := tr.do(ctx, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 12 {
+		return nil, fmt.Errorf("announce response of %d bytes is too short", len(payload))
+	}
+
+	resp := &TrackerResponse{
+		Interval:   int64(binary.BigEndian.Uint32(payload[0:4])),
+		Incomplete: int64(binary.BigEndian.Uint32(payload[4:8])),
+		Complete:   int64(binary.BigEndian.Uint32(payload[8:12])),
+	}
+
+	// Peers come in the address family of the tracker connection.
+	resp.Peers, err = decodeCompactPeerAddrs(payload[12:], ipSize)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Scrape asks the tracker for the state of the swarms of several torrents.
+//
+// Parameters:
+// - ctx: A context that cancels the request and its retransmissions.
+// - infoHashes: The 20-byte info hashes of the torrents, at most 74.
+//
+// Returns:
+// - The stats of each torrent, in the order of infoHashes.
+// - A *TrackerFailure if the tracker answers with an error, or an error if it does not answer or the answer is malformed.
+func (tr *UDPTracker) Scrape(ctx context.Context, infoHashes [][]byte) ([]ScrapeStats, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > udpMaxScrape {
+		return nil, fmt.Errorf("cannot scrape %d info hashes at once", len(infoHashes))
+	}
+
+	var body []byte
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != 20 {
+			return nil, fmt.Errorf("invalid info hash length %d", len(infoHash))
+		}
+		body = append(body, infoHash...)
+	}
+
+	payload, _, err := tr.do(ctx, udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response of %d bytes is too short for %d torrents", len(payload), len(infoHashes))
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i := range stats {
+		entry := payload[i*12 : (i+1)*12]
+		stats[i] = ScrapeStats{
+			Complete:   int64(binary.BigEndian.Uint32(entry[0:4])),
+			Downloaded: int64(binary.BigEndian.Uint32(entry[4:8])),
+			Incomplete: int64(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return stats, nil
+}
+
+// do sends a request to the tracker, connecting first if no connection id is
+// cached. A request that is not answered in time is sent again, waiting twice
+// as long each time, as BEP 15 asks, until ctx is done or tr.MaxWait has
+// passed.
+//
+// Returns:
+// - The payload of the response, after its action and transaction id.
+// - The size of the IP addresses in the response: net.IPv6len if the tracker was reached over IPv6.
+// - An error if the tracker does not answer or answers with an error.
+func (tr *UDPTracker) do(ctx context.Context, action uint32, body []byte) ([]byte, int, error) {
+	if tr.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tr.MaxWait)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", tr.Addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	// Wake up a read in progress as soon as ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	ipSize := net.IPv4len
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipSize = net.IPv6len
+	}
+
+	for n := 0; n <= tr.MaxRetries && ctx.Err() == nil; n++ {
+		timeout := tr.Timeout << n
+
+		connID, err := tr.connectionID(ctx, conn, timeout)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		payload, err := tr.exchange(ctx, conn, connID, action, body, timeout)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// The connection id may have expired on the tracker's side.
+			tr.forgetConnectionID()
+			continue
+		}
+		return payload, ipSize, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, fmt.Errorf("tracker %s did not respond: %w", tr.Addr, err)
+	}
+	return nil, 0, fmt.Errorf("tracker %s did not respond", tr.Addr)
+}
+
+// connectionID returns the cached connection id, or connects to the tracker
+// for a new one.
+func (tr *UDPTracker) connectionID(ctx context.Context, conn net.Conn, timeout time.Duration) (uint64, error) {
+	tr.mu.Lock()
+	connID, valid := tr.connID, time.Now().Before(tr.connIDUntil)
+	tr.mu.Unlock()
+
+	if valid {
+		return connID, nil
+	}
+
+	payload, err := tr.exchange(ctx, conn, udpProtocolID, udpActionConnect, nil, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) < 8 {
+		return 0, fmt.Errorf("connect response of %d bytes is too short", len(payload))
+	}
+
+	connID = binary.BigEndian.Uint64(payload[:8])
+	tr.mu.Lock()
+	tr.connID, tr.connIDUntil = connID, time.Now().Add(udpConnIDLifetime)
+	tr.mu.Unlock()
+	return connID, nil
+}
+
+// forgetConnectionID drops the cached connection id.
+func (tr *UDPTracker) forgetConnectionID() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.connIDUntil = time.Time{}
+}
+
+// exchange sends one request under a new transaction id and waits up to
+// timeout, or until ctx is done, for the response carrying the same id,
+// skipping any other packet.
+func (tr *UDPTracker) exchange(ctx context.Context, conn net.Conn, connID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	txID := make([]byte, 4)
+	if _, err := rand.Read(txID); err != nil {
+		return nil, err
+	}
+
+	packet := binary.BigEndian.AppendUint64(nil, connID)
+	packet = binary.BigEndian.AppendUint32(packet, action)
+	packet = append(append(packet, txID...), body...)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	// ctx may have been done before the deadline was set, undoing its wake up.
+	if ctx.Err() != nil {
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 8 || string(buf[4:8]) != string(txID) {
+			continue
+		}
+
+		switch binary.BigEndian.Uint32(buf[0:4]) {
+		case action:
+			return append([]byte(nil), buf[8:n]...), nil
+		case udpActionError:
+			return nil, &TrackerFailure{Reason: string(buf[8:n])}
+		}
+	}
+}
@@ -7,6 +7,7 @@ const (
 	TypeString
 	TypeList
 	TypeDict
+	TypeUnknown // a value whose type has not been determined yet
 )
 
 func (t Type) String() string {
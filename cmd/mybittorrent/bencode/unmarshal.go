@@ -0,0 +1,325 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Unmarshaler is implemented by types that can decode a bencoded representation
+// of themselves. UnmarshalBencode receives the raw encoding of a single value and
+// must copy it if it wishes to retain the data after returning.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// Unmarshal decodes the single bencoded value in data and stores the result in
+// the value pointed to by v. It mirrors Marshal: dictionaries decode into
+// structs (matching keys against `bencode` struct tags) or maps with string
+// keys, lists into slices or arrays, byte strings into strings, byte slices or
+// byte arrays, and integers into a big.Int or any integer type that can hold
+// them; an integer out of the target's range is an *OverflowError. Bools are
+// decoded from the integers 0 and 1. Keys
+// without a matching struct field are skipped. Decoding into an empty interface
+// stores the same values Decoder.Decode returns.
+func Unmarshal(data []byte, v interface{}) error {
+	return unmarshalLimited(data, v, DefaultLimits)
+}
+
+// DecodeInto decodes the next bencoded value from the input and stores it in
+// the value pointed to by v, following the rules of Unmarshal.
+func (d *Decoder) DecodeInto(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+
+	if _, err := d.reader.Peek(1); err == io.EOF {
+		return io.EOF
+	}
+	return d.decodeInto(rv.Elem())
+}
+
+// checkValid reports an error unless data holds exactly one bencoded value.
+func checkValid(data []byte) error {
+	decoder := NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.decodeValue(); err != nil {
+		return err
+	}
+
+	if decoder.InputOffset() != int64(len(data)) {
+		return fmt.Errorf("trailing data at offset %d", decoder.InputOffset())
+	}
+	return nil
+}
+
+// decodeInto decodes the next value from the input into v.
+func (d *Decoder) decodeInto(v reflect.Value) error {
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		return d.decodeUnmarshaler(v.Addr().Interface().(Unmarshaler))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeInto(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return &UnmarshalTypeError{Value: "value", Type: v.Type(), Offset: d.offset}
+		}
+		value, err := d.decodeValue()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	prefix, err := d.peekValue()
+	if err != nil {
+		return err
+	}
+
+	switch prefix {
+	case TypeInt.Prefix():
+		return d.decodeIntInto(v)
+	case TypeList.Prefix():
+		return d.decodeListInto(v)
+	case TypeDict.Prefix():
+		return d.decodeDictInto(v)
+	default:
+		return d.decodeStringInto(v)
+	}
+}
+
+// decodeUnmarshaler hands the raw encoding of the next value to u.
+func (d *Decoder) decodeUnmarshaler(u Unmarshaler) error {
+	start := d.startRaw()
+	_, err := d.decodeValue()
+	raw := d.endRaw(start)
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalBencode(raw)
+}
+
+// decodeIntInto decodes an integer into an integer-kinded, bool or big.Int v.
+func (d *Decoder) decodeIntInto(v reflect.Value) error {
+	offset := d.offset
+	numStr, err := d.decodeIntToken()
+	if err != nil {
+		return err
+	}
+
+	if v.Type() == bigIntType {
+		bigNum := v.Addr().Interface().(*big.Int)
+		bigNum.SetString(numStr, 10)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		switch numStr {
+		case "0":
+			v.SetBool(false)
+		case "1":
+			v.SetBool(true)
+		default:
+			return &OverflowError{Offset: offset, Value: numStr, Kind: v.Type().String()}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, err := strconv.ParseInt(numStr, 10, 64)
+		if err != nil || v.OverflowInt(num) {
+			return &OverflowError{Offset: offset, Value: numStr, Kind: v.Type().String()}
+		}
+		v.SetInt(num)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if strings.HasPrefix(numStr, "-") {
+			return &OverflowError{Offset: offset, Value: numStr, Kind: v.Type().String()}
+		}
+		num, err := strconv.ParseUint(strings.TrimPrefix(numStr, "+"), 10, 64)
+		if err != nil || v.OverflowUint(num) {
+			return &OverflowError{Offset: offset, Value: numStr, Kind: v.Type().String()}
+		}
+		v.SetUint(num)
+	default:
+		return &UnmarshalTypeError{Value: TypeInt.String(), Type: v.Type(), Offset: offset}
+	}
+	return nil
+}
+
+// decodeStringInto decodes a byte string into a string, byte slice or byte array v.
+func (d *Decoder) decodeStringInto(v reflect.Value) error {
+	offset := d.offset
+	data, err := d.decodeString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(data))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(data)
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(data) != v.Len() {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("string of length %d", len(data)), Type: v.Type(), Offset: offset}
+		}
+		reflect.Copy(v, reflect.ValueOf(data))
+	default:
+		return &UnmarshalTypeError{Value: TypeString.String(), Type: v.Type(), Offset: offset}
+	}
+	return nil
+}
+
+// decodeListInto decodes a list into a slice or array v.
+func (d *Decoder) decodeListInto(v reflect.Value) error {
+	offset := d.offset
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &UnmarshalTypeError{Value: TypeList.String(), Type: v.Type(), Offset: offset}
+	}
+
+	if err := d.expect(TypeList, TypeList.Prefix()); err != nil {
+		return err
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	i := 0
+	for {
+		b, err := d.peek(TypeList, "'e' or value")
+		if err != nil {
+			return err
+		}
+
+		if b == TypeList.Suffix() {
+			break
+		}
+
+		if err := d.checkElements(i+1, offset); err != nil {
+			return err
+		}
+
+		if v.Kind() == reflect.Slice {
+			if i >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+		} else if i >= v.Len() {
+			return &UnmarshalTypeError{Value: "list longer than array", Type: v.Type(), Offset: offset}
+		}
+
+		if err := d.decodeInto(v.Index(i)); err != nil {
+			return err
+		}
+		i++
+	}
+
+	if v.Kind() == reflect.Slice {
+		if i < v.Len() {
+			v.SetLen(i)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+	} else {
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	}
+
+	return d.expect(TypeList, TypeList.Suffix())
+}
+
+// decodeDictInto decodes a dictionary into a struct or a map with string keys.
+func (d *Decoder) decodeDictInto(v reflect.Value) error {
+	offset := d.offset
+	var fields map[string]field
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = make(map[string]field)
+		for _, f := range cachedFields(v.Type()) {
+			fields[f.name] = f
+		}
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return &UnmarshalTypeError{Value: TypeDict.String(), Type: v.Type(), Offset: offset}
+	}
+
+	if err := d.expect(TypeDict, TypeDict.Prefix()); err != nil {
+		return err
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	var prevKey []byte
+	count := 0
+	for {
+		b, err := d.peek(TypeDict, "'e' or key")
+		if err != nil {
+			return err
+		}
+
+		if b == TypeDict.Suffix() {
+			break
+		}
+
+		count++
+		if err := d.checkElements(count, offset); err != nil {
+			return err
+		}
+
+		keyOffset := d.offset
+		key, err := d.decodeString()
+		if err != nil {
+			return err
+		}
+
+		if err := d.checkKeyOrder(prevKey, key, keyOffset); err != nil {
+			return err
+		}
+		prevKey = key
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decodeInto(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		// Values of unknown keys, and of fields behind a nil pointer to an
+		// unexported embedded struct, are skipped.
+		var fv reflect.Value
+		if f, ok := fields[string(key)]; ok {
+			fv, _ = fieldByIndex(v, f.index, true)
+		}
+		if !fv.IsValid() {
+			if _, err := d.decodeValue(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := d.decodeInto(fv); err != nil {
+			return err
+		}
+	}
+
+	return d.expect(TypeDict, TypeDict.Suffix())
+}
@@ -3,21 +3,36 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
-func readTorrentFile(fileName string) string {
-	contents, err := os.ReadFile(fileName)
-	exitIfError(err)
-	return string(contents)
+// parseTorrentFile streams the torrent file at fileName through the bencode parser.
+func parseTorrentFile(fileName string) (*bencode.TorrentInfo, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	defer file.Close()
+
+	torrentInfo, err := bencode.CreateParser(file).ParseTorrent()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing torrent: %w", err)
+	}
+	return torrentInfo, nil
 }
 
 func convertNilToEmpty(v interface{}) interface{} {
 	switch v := v.(type) {
+	case []byte:
+		return string(v)
+
 	case []interface{}:
 		if v == nil {
 			return []interface{}{}
@@ -38,7 +53,7 @@ func convertNilToEmpty(v interface{}) interface{} {
 }
 
 func decodeBencodedValue(bencodedValue string) string {
-	decoder := bencode.NewDecoder(bencodedValue)
+	decoder := bencode.NewDecoder(strings.NewReader(bencodedValue))
 	decoded, err := decoder.Decode()
 	exitIfError(err)
 
@@ -50,44 +65,90 @@ func decodeBencodedValue(bencodedValue string) string {
 }
 
 func showPeers(fileName string) error {
-	contents, err := os.ReadFile(fileName)
+	torrentInfo, err := parseTorrentFile(fileName)
 	if err != nil {
-		return fmt.Errorf("error reading file: %w", err)
+		return err
 	}
 
-	parser := bencode.CreateParser(string(contents))
-	torrentInfo, err := parser.ParseTorrent()
+	peers, err := bencode.FindPeers(*torrentInfo)
 	if err != nil {
-		return fmt.Errorf("error parsing torrent: %w", err)
+		return fmt.Errorf("error finding peers: %w", err)
 	}
 
-	trackerResp, err := bencode.CallTracker(*torrentInfo)
-	if err != nil {
-		return fmt.Errorf("error calling tracker: %w", err)
+	for _, peer := range peers {
+		fmt.Println(peer)
 	}
 
-	peers, err := bencode.ExtractPeers(trackerResp)
+	return nil
+}
+
+// showTrackers implements the trackers command: it announces the torrent to
+// every tier of its trackers at once and prints the status of each tracker.
+func showTrackers(fileName string) error {
+	torrentInfo, err := parseTorrentFile(fileName)
 	if err != nil {
-		return fmt.Errorf("error extracting peers: %w", err)
+		return err
 	}
 
-	for _, peer := range peers {
-		fmt.Println(peer)
+	trackers := bencode.NewTrackerManager(*torrentInfo)
+	trackers.Parallel = true
+	trackers.Announce(bencode.EventNone)
+
+	for _, status := range trackers.Status() {
+		switch {
+		case status.Working:
+			fmt.Printf("Tier %d %s: working, %d peers, %d seeders, %d leechers, interval %v\n",
+				status.Tier, status.URL, status.Peers, status.Complete, status.Incomplete, status.Interval)
+			if status.Warning != "" {
+				fmt.Printf("\tWarning: %s\n", status.Warning)
+			}
+		case status.LastError != nil:
+			fmt.Printf("Tier %d %s: %v\n", status.Tier, status.URL, status.LastError)
+		default:
+			fmt.Printf("Tier %d %s: not contacted\n", status.Tier, status.URL)
+		}
 	}
-
 	return nil
 }
 
-func printPeerIdFromHandshake(fileName string, peerAddress string) error {
-	contents, err := os.ReadFile(fileName)
-	if err != nil {
-		return fmt.Errorf("error reading file: %w", err)
+// scrapeTorrents implements the scrape command: it asks the trackers of the
+// given torrents for the state of their swarms, asking each tracker about all
+// of its torrents at once.
+func scrapeTorrents(fileNames []string) error {
+	if len(fileNames) == 0 {
+		return fmt.Errorf("usage: scrape <torrent>...")
 	}
 
-	parser := bencode.CreateParser(string(contents))
-	torrentInfo, err := parser.ParseTorrent()
+	var torrents []bencode.TorrentInfo
+	for _, fileName := range fileNames {
+		torrentInfo, err := parseTorrentFile(fileName)
+		if err != nil {
+			return err
+		}
+		torrents = append(torrents, *torrentInfo)
+	}
+
+	for i, result := range bencode.ScrapeTorrents(torrents) {
+		if len(torrents) > 1 {
+			fmt.Printf("Torrent: %s\n", fileNames[i])
+		}
+
+		if result.Err != nil {
+			fmt.Printf("Error: %v\n", result.Err)
+			continue
+		}
+
+		fmt.Printf("Complete: %d\n", result.Complete)
+		fmt.Printf("Incomplete: %d\n", result.Incomplete)
+		fmt.Printf("Downloaded: %d\n", result.Downloaded)
+	}
+	return nil
+}
+
+func printPeerIdFromHandshake(fileName string, peerAddress string) error {
+	torrentInfo, err := parseTorrentFile(fileName)
 	if err != nil {
-		return fmt.Errorf("error parsing torrent: %w", err)
+		return err
 	}
 
 	conn, handshake, err := bencode.HandShakeWithPeer(*torrentInfo, peerAddress)
@@ -109,27 +170,21 @@ func printPeerIdFromHandshake(fileName string, peerAddress string) error {
 }
 
 func downloadPiece(torrentFile, outputPath string, pieceIdx int) error {
-	contents := readTorrentFile(torrentFile)
-	parser := bencode.CreateParser(contents)
-
-	torrentInfo, err := parser.ParseTorrent()
+	torrentInfo, err := parseTorrentFile(torrentFile)
 	if err != nil {
 		return err
 	}
-	
+
 	return bencode.DownLoadFile(*torrentInfo, outputPath, pieceIdx)
 }
 
 func downloadAllPieces(torrentFile, outputPath string) error {
-	contents := readTorrentFile(torrentFile)
-	parser := bencode.CreateParser(contents)
-
-	torrentInfo, err := parser.ParseTorrent()
+	torrentInfo, err := parseTorrentFile(torrentFile)
 	if err != nil {
 		return err
 	}
 
-	pieceIndices := make([]int, len(torrentInfo.PieceHashes))
+	pieceIndices := make([]int, torrentInfo.PieceCount())
 	for i := range pieceIndices {
 		pieceIndices[i] = i
 	}
@@ -137,6 +192,232 @@ func downloadAllPieces(torrentFile, outputPath string) error {
 	return bencode.DownLoadFile(*torrentInfo, outputPath, pieceIndices...)
 }
 
+// printMagnetHandshake implements the magnet_handshake command: it connects
+// to a peer of the magnet link and prints the extensions the peer supports.
+func printMagnetHandshake(magnetLink string) error {
+	magnet, err := bencode.ParseMagnet(magnetLink)
+	if err != nil {
+		return err
+	}
+
+	peer, err := bencode.MagnetHandShake(*magnet)
+	if err != nil {
+		return fmt.Errorf("error handshaking with peer: %w", err)
+	}
+	defer peer.Close()
+
+	fmt.Printf("Peer ID: %s\n", hex.EncodeToString(peer.PeerID))
+	if peer.Extensions == nil {
+		return nil
+	}
+
+	if peer.Extensions.V != "" {
+		fmt.Printf("Peer Client: %s\n", peer.Extensions.V)
+	}
+	for _, name := range peer.Extensions.Extensions() {
+		id, _ := peer.Extensions.ExtensionID(name)
+		fmt.Printf("Peer Extension: %s %d\n", name, id)
+	}
+	return nil
+}
+
+// printMagnetInfo implements the magnet_info command: it fetches the info
+// dictionary of a magnet link from its peers, prints the torrent's metadata
+// and, if torrentFile is not empty, saves the torrent there.
+func printMagnetInfo(magnetLink, torrentFile string) error {
+	magnet, err := bencode.ParseMagnet(magnetLink)
+	if err != nil {
+		return err
+	}
+
+	torrentInfo, err := bencode.ResolveMagnet(*magnet)
+	if err != nil {
+		return fmt.Errorf("error resolving magnet link: %w", err)
+	}
+
+	torrentInfo.PrintStats()
+	if torrentFile == "" {
+		return nil
+	}
+
+	file, err := os.Create(torrentFile)
+	if err != nil {
+		return err
+	}
+
+	err = bencode.WriteTorrent(*torrentInfo, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(torrentFile)
+		return fmt.Errorf("error saving torrent: %w", err)
+	}
+	return nil
+}
+
+// downloadMagnet implements the magnet_download command: it resolves the
+// torrent a magnet link refers to and downloads it, or only the files the
+// link selects with "so".
+func downloadMagnet(magnetLink, outputPath string) error {
+	magnet, err := bencode.ParseMagnet(magnetLink)
+	if err != nil {
+		return err
+	}
+
+	torrentInfo, err := bencode.ResolveMagnet(*magnet)
+	if err != nil {
+		return fmt.Errorf("error resolving magnet link: %w", err)
+	}
+
+	var pieceIndices []int
+	if magnet.SelectOnly != nil {
+		pieceIndices = torrentInfo.PiecesForFiles(magnet.SelectedFiles(len(torrentInfo.Files)))
+	} else {
+		pieceIndices = make([]int, torrentInfo.PieceCount())
+		for i := range pieceIndices {
+			pieceIndices[i] = i
+		}
+	}
+
+	return bencode.DownLoadFile(*torrentInfo, outputPath, pieceIndices...)
+}
+
+// defaultDHTStateFile returns where the DHT routing table is kept between
+// runs, or an empty string if there is no user cache directory.
+func defaultDHTStateFile() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "mybittorrent", "dht.dat")
+}
+
+// dhtPeers implements the dht_peers command:
+//
+//	dht_peers [-addr <listen address>] [-b <host:port>]... [-state <file>] [-announce <port>] <info hash>
+//
+// It joins the DHT, looks up the peers of the info hash and prints them.
+func dhtPeers(args []string) error {
+	flags := flag.NewFlagSet("dht_peers", flag.ExitOnError)
+	addr := flags.String("addr", "", "UDP address to listen on (default any port)")
+	stateFile := flags.String("state", defaultDHTStateFile(), "file the routing table is kept in between runs; empty disables it")
+	announcePort := flags.Int("announce", -1, "announce this peer on the given TCP port; 0 uses the DHT port")
+	var bootstrap stringsFlag
+	flags.Var(&bootstrap, "b", "bootstrap node host:port; may be repeated (default the well-known routers)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: dht_peers [flags] <info hash>")
+	}
+
+	infoHash, err := bencode.ParseNodeID(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dht, err := bencode.NewDHT(bencode.DHTConfig{
+		Addr:           *addr,
+		BootstrapNodes: bootstrap,
+		StateFile:      *stateFile,
+	})
+	if err != nil {
+		return err
+	}
+	defer dht.Close()
+
+	if err := dht.Bootstrap(); err != nil {
+		return err
+	}
+
+	var peers []string
+	if *announcePort >= 0 {
+		peers, err = dht.AnnouncePeer(infoHash, *announcePort)
+	} else {
+		peers, err = dht.GetPeers(infoHash)
+	}
+	if err != nil {
+		return fmt.Errorf("error finding peers: %w", err)
+	}
+
+	for _, peer := range peers {
+		fmt.Println(peer)
+	}
+	return nil
+}
+
+// stringsFlag collects every value of a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// createTorrent implements the create command:
+//
+//	create -o <output.torrent> [-a <tracker>[,<tracker>...]]... [-c <comment>] [-private] [-w <web seed>]... [-l <piece length>] <path>
+//
+// Every -a flag adds a tracker tier; trackers separated by commas share a tier.
+func createTorrent(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	outputPath := flags.String("o", "", "path of the .torrent file to write (default <name>.torrent)")
+	comment := flags.String("c", "", "comment stored in the torrent")
+	private := flags.Bool("private", false, "mark the torrent private (BEP 27)")
+	pieceLength := flags.Int64("l", 0, "piece length in bytes (default chosen from the total size)")
+	var trackers, webSeeds stringsFlag
+	flags.Var(&trackers, "a", "announce URL tier, trackers separated by commas; may be repeated")
+	flags.Var(&webSeeds, "w", "web seed URL; may be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: create [flags] <path>")
+	}
+
+	opts := bencode.CreateOptions{
+		Path:        flags.Arg(0),
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+	}
+	for _, tier := range trackers {
+		opts.Trackers = append(opts.Trackers, strings.Split(tier, ","))
+	}
+
+	if *outputPath == "" {
+		*outputPath = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+
+	file, err := os.Create(*outputPath)
+	if err != nil {
+		return err
+	}
+
+	infoHash, err := bencode.CreateTorrent(opts, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*outputPath)
+		return fmt.Errorf("error creating torrent: %w", err)
+	}
+
+	fmt.Printf("Created %s\n", *outputPath)
+	fmt.Printf("Info Hash: %s\n", infoHash)
+	return nil
+}
+
 func main() {
 	command := os.Args[1]
 
@@ -147,11 +428,7 @@ func main() {
 
 	case "info":
 		fileName := os.Args[2]
-		contents, err := os.ReadFile(fileName)
-		exitIfError(err)
-
-		parser := bencode.CreateParser(string(contents))
-		torrentInfo, err := parser.ParseTorrent()
+		torrentInfo, err := parseTorrentFile(fileName)
 		exitIfError(err)
 
 		torrentInfo.PrintStats()
@@ -161,6 +438,14 @@ func main() {
 		err := showPeers(fileName)
 		exitIfError(err)
 
+	case "trackers":
+		err := showTrackers(os.Args[2])
+		exitIfError(err)
+
+	case "scrape":
+		err := scrapeTorrents(os.Args[2:])
+		exitIfError(err)
+
 	case "handshake":
 		fileName := os.Args[2]
 		peerAddress := os.Args[3]
@@ -184,6 +469,40 @@ func main() {
 		err := downloadAllPieces(fileName, outputPath)
 		exitIfError(err)
 
+	case "magnet_parse":
+		magnet, err := bencode.ParseMagnet(os.Args[2])
+		exitIfError(err)
+
+		magnet.PrintStats()
+
+	case "magnet_handshake":
+		err := printMagnetHandshake(os.Args[2])
+		exitIfError(err)
+
+	case "magnet_info":
+		var torrentFile string
+		if len(os.Args) > 3 {
+			torrentFile = os.Args[3]
+		}
+
+		err := printMagnetInfo(os.Args[2], torrentFile)
+		exitIfError(err)
+
+	case "magnet_download":
+		outputPath := os.Args[3]
+		magnetLink := os.Args[4]
+
+		err := downloadMagnet(magnetLink, outputPath)
+		exitIfError(err)
+
+	case "dht_peers":
+		err := dhtPeers(os.Args[2:])
+		exitIfError(err)
+
+	case "create":
+		err := createTorrent(os.Args[2:])
+		exitIfError(err)
+
 	default:
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)